@@ -3,10 +3,14 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 
 	"net/http"
 
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
 	"github.com/Simon-Busch/go_crypto_exchange/server"
 	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
 )
@@ -19,11 +23,33 @@ type Client struct {
 
 type PlaceOrderParams struct {
 	UserID int64
+	Market server.Market
 	Bid    bool
 	//Price only needed for placing LIMIT order
 	// For buy order, it will always be filled at the best price
-	Price  float64
-	Size   float64
+	Price  decimal.Decimal
+	Size   decimal.Decimal
+	// Defaults to GTC for LIMIT orders, MARKET orders are rejected when
+	// the book can't fill them unless IOC is used
+	TimeInForce orderbook.TimeInForce
+	// Expiry of a GTD order as a unix nano timestamp
+	ExpiresAt   int64
+	// Post-only LIMIT orders never take liquidity, they are rejected
+	// or repriced one tick away from the touch with PostOnlyReprice
+	PostOnly        bool
+	PostOnlyReprice bool
+	// Iceberg LIMIT orders only show DisplaySize of their Size in the book
+	DisplaySize     decimal.Decimal
+	// Slippage protection of MARKET orders, either the worst acceptable
+	// price or a maximum distance from the touch in basis points
+	WorstPrice      decimal.Decimal
+	MaxSlippageBps  int64
+	// Overrides the self-trade prevention of the account for this order
+	SelfTradePrevention orderbook.SelfTradePrevention
+	// Optional ID of the order chosen by the caller. An order placed again
+	// with the same ID, e.g. when retrying after a timeout, is not placed
+	// twice: the result of the first placement is returned instead.
+	ClientOrderID string
 }
 
 func NewClient() *Client {
@@ -32,8 +58,8 @@ func NewClient() *Client {
 	}
 }
 
-func (c *Client) GetBestAsk() (*server.Order, error) {
-	e := fmt.Sprintf("%s/book/ETH/bestask", Endpoint)
+func (c *Client) GetBestAsk(market server.Market) (*server.Order, error) {
+	e := fmt.Sprintf("%s/book/%s/bestask", Endpoint, market)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
@@ -52,8 +78,8 @@ func (c *Client) GetBestAsk() (*server.Order, error) {
 	return order, err
 }
 
-func (c *Client) GetBestBid() (*server.Order, error) {
-	e := fmt.Sprintf("%s/book/ETH/bestbid", Endpoint)
+func (c *Client) GetBestBid(market server.Market) (*server.Order, error) {
+	e := fmt.Sprintf("%s/book/%s/bestbid", Endpoint, market)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
@@ -73,7 +99,56 @@ func (c *Client) GetBestBid() (*server.Order, error) {
 }
 
 
-func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
+// GetMarkets returns every market of the exchange
+func (c *Client) GetMarkets() ([]server.MarketSpec, error) {
+	e := fmt.Sprintf("%s/markets", Endpoint)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	markets := []server.MarketSpec{}
+	if err := json.NewDecoder(resp.Body).Decode(&markets); err != nil {
+		return nil, err
+	}
+
+	return markets, nil
+}
+
+func (c *Client) GetMarket(market server.Market) (*server.MarketSpec, error) {
+	e := fmt.Sprintf("%s/markets/%s", Endpoint, market)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	spec := &server.MarketSpec{}
+	if err := json.NewDecoder(resp.Body).Decode(spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+func (c *Client) GetTrades(market server.Market) ([]*orderbook.Trade, error) {
 	e := fmt.Sprintf("%s/trades/%s", Endpoint, market)
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -85,6 +160,10 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
 	trades := []*orderbook.Trade{}
 	if err := json.NewDecoder(resp.Body).Decode(&trades); err != nil {
 		return nil, err
@@ -99,7 +178,12 @@ func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 		Type: server.MarketOrder,
 		Bid: p.Bid,
 		Size: p.Size,
-		Market: server.MarketETH,
+		Market: p.Market,
+		TimeInForce: p.TimeInForce,
+		WorstPrice: p.WorstPrice,
+		MaxSlippageBps: p.MaxSlippageBps,
+		SelfTradePrevention: p.SelfTradePrevention,
+		ClientOrderID: p.ClientOrderID,
 	}
 
 	body, err := json.Marshal(params)
@@ -118,6 +202,10 @@ func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
 	placeOrderResponse := &server.PlaceOrderResponse{}
 	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
 		return nil, err
@@ -141,6 +229,116 @@ func (c *Client) CancelOrder(orderID int64) error {
 	return nil
 }
 
+// AmendOrder moves a resting order to price with a remaining size, a zero
+// price or size keeps the current one. Only a size decrease keeps the time
+// priority of the order.
+func (c *Client) AmendOrder(orderID int64, price, size decimal.Decimal) (*server.PlaceOrderResponse, error) {
+	params := &server.AmendOrderRequest{
+		Price: price,
+		Size: 	size,
+	}
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	e := fmt.Sprintf("%s/order/%d", Endpoint, orderID)
+	req, err := http.NewRequest(http.MethodPut, e, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	amendResponse := &server.PlaceOrderResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(amendResponse); err != nil {
+		return nil, err
+	}
+
+	return amendResponse, nil
+}
+
+// CancelAll cancels every order of a user, an empty market or side
+// (BID or ASK) cancels the orders of all the markets or sides.
+// It returns the IDs of the cancelled orders.
+func (c *Client) CancelAll(userID int64, market server.Market, side string) ([]int64, error) {
+	params := url.Values{}
+	params.Set("userID", strconv.FormatInt(userID, 10))
+	if market != "" {
+		params.Set("market", string(market))
+	}
+	if side != "" {
+		params.Set("side", side)
+	}
+
+	e := fmt.Sprintf("%s/orders?%s", Endpoint, params.Encode())
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	cancelResponse := &server.CancelOrdersResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(cancelResponse); err != nil {
+		return nil, err
+	}
+
+	return cancelResponse.OrderIDs, nil
+}
+
+// PlaceOrders places a batch of orders in a single request, each order gets
+// its own result. With allOrNothing either all the orders are placed or none,
+// they then have to be limit orders which rest in the book without trading.
+func (c *Client) PlaceOrders(orders []server.PlaceOrderRequest, allOrNothing bool) (*server.PlaceOrdersResponse, error) {
+	params := &server.PlaceOrdersRequest{
+		Orders: 			orders,
+		AllOrNothing: allOrNothing,
+	}
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	e := fmt.Sprintf("%s/orders/batch", Endpoint)
+	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	placeOrdersResponse := &server.PlaceOrdersResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(placeOrdersResponse); err != nil {
+		return nil, err
+	}
+
+	return placeOrdersResponse, nil
+}
+
 func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
 	if p.Size == 0 {
 		return nil, fmt.Errorf("size cannot be 0 when placing a limit order")
@@ -152,7 +350,14 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 		Bid: p.Bid,
 		Size: p.Size,
 		Price: p.Price,
-		Market: server.MarketETH,
+		Market: p.Market,
+		TimeInForce: p.TimeInForce,
+		ExpiresAt: p.ExpiresAt,
+		PostOnly: p.PostOnly,
+		PostOnlyReprice: p.PostOnlyReprice,
+		DisplaySize: p.DisplaySize,
+		SelfTradePrevention: p.SelfTradePrevention,
+		ClientOrderID: p.ClientOrderID,
 	}
 
 	body, err := json.Marshal(params)
@@ -171,6 +376,10 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
 	placeOrderResponse := &server.PlaceOrderResponse{}
 	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
 		return nil, err
@@ -198,3 +407,198 @@ func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 
 	return &orders, nil
 }
+
+// GetOrderByClientID returns the status of the order a user placed with a client order ID
+func (c *Client) GetOrderByClientID(userID int64, clientOrderID string) (*server.OrderRecord, error) {
+	e := fmt.Sprintf("%s/users/%d/orders/%s", Endpoint, userID, url.PathEscape(clientOrderID))
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	record := &server.OrderRecord{}
+	if err := json.NewDecoder(resp.Body).Decode(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (c *Client) CancelOrderByClientID(userID int64, clientOrderID string) error {
+	e := fmt.Sprintf("%s/users/%d/orders/%s", Endpoint, userID, url.PathEscape(clientOrderID))
+	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeAPIError(resp)
+	}
+
+	return nil
+}
+
+// UpdateUserSettings replaces the defaults applied to the orders of a user
+func (c *Client) UpdateUserSettings(userID int64, settings server.UserSettings) error {
+	body, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	e := fmt.Sprintf("%s/users/%d/settings", Endpoint, userID)
+	req, err := http.NewRequest(http.MethodPut, e, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeAPIError(resp)
+	}
+
+	return nil
+}
+
+// GetOrder returns the status of an order, also once it left the book
+func (c *Client) GetOrder(id int64) (*server.OrderRecord, error) {
+	e := fmt.Sprintf("%s/order/status/%d", Endpoint, id)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	record := &server.OrderRecord{}
+	if err := json.NewDecoder(resp.Body).Decode(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// GetFills returns a page of the fills of a user, use the NextCursor of
+// the response as the Cursor of the query to get the next page
+func (c *Client) GetFills(userID int64, q server.FillsQuery) (*server.GetFillsResponse, error) {
+	params := url.Values{}
+	if q.Market != "" {
+		params.Set("market", string(q.Market))
+	}
+	if q.Start != 0 {
+		params.Set("start", strconv.FormatInt(q.Start, 10))
+	}
+	if q.End != 0 {
+		params.Set("end", strconv.FormatInt(q.End, 10))
+	}
+	if q.Cursor != "" {
+		params.Set("cursor", q.Cursor)
+	}
+	if q.Limit != 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	e := fmt.Sprintf("%s/fills/%d?%s", Endpoint, userID, params.Encode())
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	fills := &server.GetFillsResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(fills); err != nil {
+		return nil, err
+	}
+
+	return fills, nil
+}
+
+func (c *Client) GetBalances(userID int64) ([]server.Balance, error) {
+	e := fmt.Sprintf("%s/balances/%d", Endpoint, userID)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	balances := &server.GetBalancesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(balances); err != nil {
+		return nil, err
+	}
+
+	return balances.Balances, nil
+}
+
+func (c *Client) GetSettlement(tradeID int64) (*server.SettlementRecord, error) {
+	e := fmt.Sprintf("%s/settlements/%d", Endpoint, tradeID)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(resp)
+	}
+
+	record := &server.SettlementRecord{}
+	if err := json.NewDecoder(resp.Body).Decode(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// decodeAPIError turns a non 200 response of the exchange into an error
+func decodeAPIError(resp *http.Response) error {
+	apiErr := server.APIError{}
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		return fmt.Errorf("exchange responded with status %d", resp.StatusCode)
+	}
+
+	return errors.New(apiErr.Error)
+}
@@ -0,0 +1,198 @@
+package decimal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Number of decimals a Decimal can hold, each market then restricts its
+// prices and sizes to a coarser precision with Unit
+const Decimals = 8
+
+// Fixed-point number with Decimals decimals, stored as an integer number of
+// 10^-Decimals units so that adding, subtracting and comparing them is exact.
+// Like time.Duration, constants are built by multiplying One: 5 * decimal.One
+type Decimal int64
+
+const (
+	Zero Decimal = 0
+	One  Decimal = 100_000_000
+)
+
+// The result of a multiplication doesn't fit in a Decimal
+var ErrOverflow = errors.New("decimal overflow")
+
+// Unit is the smallest step of a precision of the given number of decimals,
+// Unit(2) is 0.01
+func Unit(decimals int) Decimal {
+	unit := One
+	for i := 0; i < decimals && i < Decimals; i++ {
+		unit /= 10
+	}
+	return unit
+}
+
+func FromInt(i int64) Decimal {
+	return Decimal(i) * One
+}
+
+// Parse reads a decimal string such as "1000.25", it fails if the value has
+// more than Decimals decimals instead of silently rounding it
+func Parse(s string) (Decimal, error) {
+	str := strings.TrimSpace(s)
+	negative := strings.HasPrefix(str, "-")
+	if negative {
+		str = str[1:]
+	} else {
+		str = strings.TrimPrefix(str, "+")
+	}
+
+	intPart, fracPart, _ := strings.Cut(str, ".")
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("invalid decimal: %q", s)
+	}
+	if len(fracPart) > Decimals {
+		return 0, fmt.Errorf("decimal %q has more than %d decimals", s, Decimals)
+	}
+
+	value := int64(0)
+	if intPart != "" {
+		// ParseUint rejects a second sign, which ParseInt would accept
+		i, err := strconv.ParseUint(intPart, 10, 64)
+		if err != nil || i > uint64(maxInt) {
+			return 0, fmt.Errorf("invalid decimal: %q", s)
+		}
+		value = int64(i) * int64(One)
+	}
+
+	if fracPart != "" {
+		frac, err := strconv.ParseUint(fracPart, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid decimal: %q", s)
+		}
+		for i := len(fracPart); i < Decimals; i++ {
+			frac *= 10
+		}
+		if value > math.MaxInt64-int64(frac) {
+			return 0, fmt.Errorf("invalid decimal: %q", s)
+		}
+		value += int64(frac)
+	}
+
+	if negative {
+		value = -value
+	}
+
+	return Decimal(value), nil
+}
+
+// Largest integer part a Decimal can hold
+const maxInt = Decimal(1<<63-1) / One
+
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) String() string {
+	sign := ""
+	value := uint64(d)
+	if d < 0 {
+		sign = "-"
+		value = uint64(-d)
+	}
+
+	intPart := value / uint64(One)
+	fracPart := value % uint64(One)
+	if fracPart == 0 {
+		return fmt.Sprintf("%s%d", sign, intPart)
+	}
+
+	frac := strings.TrimRight(fmt.Sprintf("%0*d", Decimals, fracPart), "0")
+	return fmt.Sprintf("%s%d.%s", sign, intPart, frac)
+}
+
+func (d Decimal) Float64() float64 {
+	return float64(d) / float64(One)
+}
+
+// IsMultipleOf reports whether d is a whole number of steps, e.g. of a tick size
+func (d Decimal) IsMultipleOf(step Decimal) bool {
+	return step != 0 && d%step == 0
+}
+
+// Mul multiplies two decimals, the result is truncated to Decimals decimals.
+// It panics when the result overflows, CheckedMul is the one to use on
+// values that haven't been validated yet.
+func (d Decimal) Mul(o Decimal) Decimal {
+	return d.MulDiv(int64(o), int64(One))
+}
+
+// MulDiv returns d * num / den truncated to Decimals decimals, without
+// overflowing on the intermediate product. Like Mul it panics when the
+// result overflows.
+func (d Decimal) MulDiv(num, den int64) Decimal {
+	result, err := d.CheckedMulDiv(num, den)
+	if err != nil {
+		panic(fmt.Errorf("%s * %d / %d: %w", d, num, den, err))
+	}
+	return result
+}
+
+// CheckedMul is Mul returning ErrOverflow instead of panicking
+func (d Decimal) CheckedMul(o Decimal) (Decimal, error) {
+	return d.CheckedMulDiv(int64(o), int64(One))
+}
+
+// CheckedMulDiv is MulDiv returning ErrOverflow instead of panicking
+func (d Decimal) CheckedMulDiv(num, den int64) (Decimal, error) {
+	product := new(big.Int).Mul(big.NewInt(int64(d)), big.NewInt(num))
+	product.Quo(product, big.NewInt(den))
+	if !product.IsInt64() {
+		return 0, ErrOverflow
+	}
+	return Decimal(product.Int64()), nil
+}
+
+// ToBaseUnits converts d to the integer base units of an asset with the given
+// number of decimals, e.g. wei for ETH with 18 decimals. The conversion is
+// exact as long as the asset has at least Decimals decimals.
+func (d Decimal) ToBaseUnits(assetDecimals int) *big.Int {
+	units := big.NewInt(int64(d))
+	exp := assetDecimals - Decimals
+	if exp >= 0 {
+		return units.Mul(units, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+	}
+	return units.Quo(units, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exp)), nil))
+}
+
+// Decimals are sent as JSON strings so that no client parses them as floats
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON accepts both JSON strings and JSON numbers
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	str := string(bytes.Trim(data, `"`))
+	if str == "null" || str == "" {
+		*d = Zero
+		return nil
+	}
+
+	value, err := Parse(str)
+	if err != nil {
+		return err
+	}
+
+	*d = value
+	return nil
+}
@@ -0,0 +1,82 @@
+package decimal
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	d, err := Parse("1000.25")
+	assert.Nil(t, err)
+	assert.Equal(t, d, 1000*One+One/4)
+
+	d, err = Parse("-0.00000001")
+	assert.Nil(t, err)
+	assert.Equal(t, d, Decimal(-1))
+
+	_, err = Parse("0.000000001")
+	assert.NotNil(t, err)
+
+	_, err = Parse("1e3")
+	assert.NotNil(t, err)
+
+	_, err = Parse(".")
+	assert.NotNil(t, err)
+
+	d, err = Parse("92233720368.54775807")
+	assert.Nil(t, err)
+	assert.Equal(t, d, Decimal(math.MaxInt64))
+
+	for _, s := range []string{"--5", "-+5", "+-5", "++5", "-", "1.-5", "92233720368.54775808", "92233720368.99999999", "-92233720368.99999999", "92233720369"} {
+		_, err = Parse(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, (10_000 * One).String(), "10000")
+	assert.Equal(t, MustParse("0.1").String(), "0.1")
+	assert.Equal(t, MustParse("-12.3400").String(), "-12.34")
+	assert.Equal(t, Decimal(1).String(), "0.00000001")
+}
+
+func TestExactArithmetic(t *testing.T) {
+	// 0.1 + 0.2 == 0.3 which doesn't hold with float64
+	assert.Equal(t, MustParse("0.1")+MustParse("0.2"), MustParse("0.3"))
+	assert.Equal(t, MustParse("1.5").Mul(MustParse("2000.01")), MustParse("3000.015"))
+	assert.Equal(t, (10_000 * One).MulDiv(10_050, 10_000), 10_050*One)
+	assert.Equal(t, MustParse("1000.05").IsMultipleOf(Unit(2)), true)
+	assert.Equal(t, MustParse("1000.005").IsMultipleOf(Unit(2)), false)
+}
+
+func TestMulOverflow(t *testing.T) {
+	_, err := MustParse("1000000").CheckedMul(MustParse("1000000"))
+	assert.ErrorIs(t, err, ErrOverflow)
+
+	d, err := MustParse("1000").CheckedMul(MustParse("1000"))
+	assert.Nil(t, err)
+	assert.Equal(t, d, 1_000_000*One)
+
+	assert.Panics(t, func() { MustParse("1000000").Mul(MustParse("1000000")) })
+}
+
+func TestToBaseUnits(t *testing.T) {
+	assert.Equal(t, MustParse("1.5").ToBaseUnits(18).String(), "1500000000000000000")
+	assert.Equal(t, Decimal(1).ToBaseUnits(18), big.NewInt(10_000_000_000))
+	assert.Equal(t, MustParse("12.345678").ToBaseUnits(6).String(), "12345678")
+}
+
+func TestJSON(t *testing.T) {
+	b, err := json.Marshal(MustParse("1000.5"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), `"1000.5"`)
+
+	var values []Decimal
+	err = json.Unmarshal([]byte(`["0.3", 12.75, null]`), &values)
+	assert.Nil(t, err)
+	assert.Equal(t, values, []Decimal{MustParse("0.3"), MustParse("12.75"), Zero})
+}
@@ -5,8 +5,10 @@ import (
 	"time"
 
 	"github.com/Simon-Busch/go_crypto_exchange/client"
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
 	"github.com/Simon-Busch/go_crypto_exchange/mm"
 	"github.com/Simon-Busch/go_crypto_exchange/server"
+	"github.com/sirupsen/logrus"
 )
 
 
@@ -18,12 +20,13 @@ func main() {
 
 	cfg := mm.Config{
 		UserID: 				9,
-		OrderSize: 			10,
-		MinSpread: 			20, // ordersize * 2 would be good
-		SeedOffset: 		40,
+		Market: 				server.MarketETH,
+		OrderSize: 			10 * decimal.One,
+		MinSpread: 			20 * decimal.One, // ordersize * 2 would be good
+		SeedOffset: 		40 * decimal.One,
 		ExchangeClient: clt,
 		MakeInterval: 	1 * time.Second,
-		PriceOffset: 		10,
+		PriceOffset: 		10 * decimal.One,
 	}
 	maker := mm.NewMarketMaker(cfg)
 	maker.Start()
@@ -47,13 +50,15 @@ func marketOrderPlacer(c *client.Client) {
 
 		order := &client.PlaceOrderParams{
 			UserID: 1,
+			Market: server.MarketETH,
 			Bid: 		bid,
-			Size:		1,
+			Size:		decimal.One,
 		}
 
+		// An empty or thin book rejects the order, we just try again on the next tick
 		_, err := c.PlaceMarketOrder(order)
 		if err != nil {
-			panic(err)
+			logrus.Error(err)
 		}
 
 		<- ticker.C
@@ -4,33 +4,38 @@ import (
 	"time"
 
 	"github.com/Simon-Busch/go_crypto_exchange/client"
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/server"
 	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
 	UserID 					int64
-	OrderSize 			float64
-	MinSpread 			float64
-	SeedOffset 			float64
+	Market 					server.Market
+	OrderSize 			decimal.Decimal
+	MinSpread 			decimal.Decimal
+	SeedOffset 			decimal.Decimal
 	ExchangeClient 	*client.Client
 	MakeInterval 		time.Duration
-	PriceOffset 		float64
+	PriceOffset 		decimal.Decimal
 }
 
 type MarketMaker struct {
 	userID 					int64
-	orderSize 			float64
-	minSpread 			float64
-	seedOffset 			float64
+	market 					server.Market
+	orderSize 			decimal.Decimal
+	minSpread 			decimal.Decimal
+	seedOffset 			decimal.Decimal
 	exchangeClient 	*client.Client
 	makeInterval 		time.Duration
-	priceOffset 		float64
+	priceOffset 		decimal.Decimal
 }
 
 
 func NewMarketMaker(cfc Config) *MarketMaker {
 	return &MarketMaker{
 		userID: 				cfc.UserID,
+		market: 				cfc.Market,
 		orderSize: 			cfc.OrderSize,
 		minSpread: 			cfc.MinSpread,
 		seedOffset: 		cfc.SeedOffset,
@@ -43,6 +48,7 @@ func NewMarketMaker(cfc Config) *MarketMaker {
 func (mm *MarketMaker) Start() {
 	logrus.WithFields(logrus.Fields{
 		"userID": 			mm.userID,
+		"market": 			mm.market,
 		"orderSize": 		mm.orderSize,
 		"minSpread": 		mm.minSpread,
 		"makeInterval": mm.makeInterval,
@@ -54,19 +60,19 @@ func (mm *MarketMaker) Start() {
 func (mm *MarketMaker) makerLoop() {
 	ticker := time.NewTicker(mm.makeInterval)
 	for {
-		bestBid, err := mm.exchangeClient.GetBestBid()
+		bestBid, err := mm.exchangeClient.GetBestBid(mm.market)
 		if err != nil {
 			logrus.Error(err)
 			break;
 		}
 
-		bestAsk, err := mm.exchangeClient.GetBestAsk()
+		bestAsk, err := mm.exchangeClient.GetBestAsk(mm.market)
 		if err != nil {
 			logrus.Error(err)
 			break;
 		}
 
-		if bestAsk.Price == 0.0 && bestBid.Price == 0.0 {
+		if bestAsk.Price == 0 && bestBid.Price == 0 {
 			if err := mm.seedMarket(); err != nil {
 				logrus.Error(err)
 				break;
@@ -74,11 +80,11 @@ func (mm *MarketMaker) makerLoop() {
 			continue
 		}
 
-		if bestBid.Price == 0.0 {
+		if bestBid.Price == 0 {
 			bestBid.Price = bestAsk.Price - mm.priceOffset * 2
 		}
 
-		if bestAsk.Price == 0.0 {
+		if bestAsk.Price == 0 {
 			bestAsk.Price = bestBid.Price + mm.priceOffset * 2
 		}
 
@@ -99,14 +105,30 @@ func (mm *MarketMaker) makerLoop() {
 
 		<- ticker.C
 	}
+
+	// Don't leave stale quotes behind once the maker stops quoting
+	cancelled, err := mm.exchangeClient.CancelAll(mm.userID, mm.market, "")
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID": mm.userID,
+		"count": 	len(cancelled),
+	}).Info("Market maker cancelled its quotes")
 }
 
-func (mm *MarketMaker) placeOrder(bid bool, price float64) error {
+func (mm *MarketMaker) placeOrder(bid bool, price decimal.Decimal) error {
 	bidOrder := &client.PlaceOrderParams{
 		UserID: 			mm.userID,
+		Market: 			mm.market,
 		Bid: 					bid,
 		Size: 				mm.orderSize,
 		Price:				price,
+		// The market maker must never take liquidity
+		PostOnly: 					true,
+		PostOnlyReprice: 		true,
 	}
 
 	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
@@ -126,9 +148,12 @@ func (mm *MarketMaker) seedMarket() error {
 
 	bidOrder := &client.PlaceOrderParams{
 		UserID: 			mm.userID,
+		Market: 			mm.market,
 		Bid: 					true,
 		Size: 				mm.orderSize,
 		Price:				currentPrice - mm.seedOffset,
+		PostOnly: 					true,
+		PostOnlyReprice: 		true,
 	}
 
 	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
@@ -138,9 +163,12 @@ func (mm *MarketMaker) seedMarket() error {
 
 	askOrder := &client.PlaceOrderParams{
 		UserID: 			mm.userID,
+		Market: 			mm.market,
 		Bid: 					false,
 		Size: 				mm.orderSize,
 		Price:				currentPrice + mm.seedOffset,
+		PostOnly: 					true,
+		PostOnlyReprice: 		true,
 	}
 
 	_, err = mm.exchangeClient.PlaceLimitOrder(askOrder)
@@ -153,8 +181,8 @@ func (mm *MarketMaker) seedMarket() error {
 
 // This will simulate a call to an order exchange to fetch
 // the current ETH price so we can offset both for bids and asks
-func simulateFetchCurrentETHPrice() float64 {
+func simulateFetchCurrentETHPrice() decimal.Decimal {
 	time.Sleep(80 * time.Millisecond)
 
-	return 1000.0
+	return 1000 * decimal.One
 }
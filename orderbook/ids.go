@@ -0,0 +1,92 @@
+package orderbook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of IDs reserved on disk at once, so that the file is only written
+// once per block instead of once per ID
+const idBlockSize = 1_000
+
+// Monotonic ID sequence safe for concurrent use. When it has a path, the
+// highest reserved ID is persisted there and a restarted generator carries
+// on after it, skipping the unused part of the last block.
+type IDGenerator struct {
+	mu       sync.Mutex
+	path     string
+	last     int64
+	reserved int64
+}
+
+// NewIDGenerator loads the sequence persisted at path, an empty path keeps it in memory only
+func NewIDGenerator(path string) (*IDGenerator, error) {
+	g := &IDGenerator{path: path}
+	if path == "" {
+		return g, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reserved, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID sequence in %s: %w", path, err)
+	}
+
+	g.last = reserved
+	g.reserved = reserved
+
+	return g, nil
+}
+
+// Next returns the next ID of the sequence. When the next block can't be
+// persisted the error is returned along with an ID which is still unique
+// for the lifetime of the process, but could be handed out again after a restart.
+func (g *IDGenerator) Next() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var err error
+	if g.path != "" && g.last >= g.reserved {
+		err = g.reserve(g.last + idBlockSize)
+	}
+
+	g.last++
+	return g.last, err
+}
+
+// MustNext is Next for the in memory generators which can't fail
+func (g *IDGenerator) MustNext() int64 {
+	id, err := g.Next()
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (g *IDGenerator) reserve(reserved int64) error {
+	if err := os.MkdirAll(filepath.Dir(g.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := g.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(reserved, 10)), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, g.path); err != nil {
+		return err
+	}
+
+	g.reserved = reserved
+	return nil
+}
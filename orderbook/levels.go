@@ -0,0 +1,140 @@
+package orderbook
+
+import (
+	"math/rand"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+)
+
+const maxSkipLevel = 24
+
+// Price levels of one side of the book kept in a skiplist, ordered from the
+// best price to the worst one. The best level is the first node so it is
+// found in O(1), inserting and removing a level is O(log n).
+type levels struct {
+	head   *levelNode
+	height int
+	length int
+	// better reports whether price a comes before price b on this side
+	better func(a, b decimal.Decimal) bool
+}
+
+type levelNode struct {
+	limit *Limit
+	next  []*levelNode
+}
+
+func newAskLevels() *levels {
+	return newLevels(func(a, b decimal.Decimal) bool { return a < b })
+}
+
+func newBidLevels() *levels {
+	return newLevels(func(a, b decimal.Decimal) bool { return a > b })
+}
+
+func newLevels(better func(a, b decimal.Decimal) bool) *levels {
+	return &levels{
+		head:   &levelNode{next: make([]*levelNode, maxSkipLevel)},
+		height: 1,
+		better: better,
+	}
+}
+
+func (ls *levels) Len() int {
+	return ls.length
+}
+
+// Best returns the level with the best price, nil when the side is empty
+func (ls *levels) Best() *Limit {
+	first := ls.head.next[0]
+	if first == nil {
+		return nil
+	}
+	return first.limit
+}
+
+// Insert adds a new price level, the price must not be in the list yet
+func (ls *levels) Insert(limit *Limit) {
+	update := ls.predecessors(limit.Price)
+
+	height := randomSkipHeight()
+	if height > ls.height {
+		for i := ls.height; i < height; i++ {
+			update[i] = ls.head
+		}
+		ls.height = height
+	}
+
+	node := &levelNode{limit: limit, next: make([]*levelNode, height)}
+	for i := 0; i < height; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+
+	ls.length++
+}
+
+// Remove deletes the level at the given price if there is one
+func (ls *levels) Remove(price decimal.Decimal) {
+	update := ls.predecessors(price)
+
+	node := update[0].next[0]
+	if node == nil || node.limit.Price != price {
+		return
+	}
+
+	for i := 0; i < ls.height; i++ {
+		if update[i].next[i] != node {
+			break
+		}
+		update[i].next[i] = node.next[i]
+	}
+
+	for ls.height > 1 && ls.head.next[ls.height-1] == nil {
+		ls.height--
+	}
+
+	ls.length--
+}
+
+// Each walks the levels from the best price, until fn returns false
+func (ls *levels) Each(fn func(limit *Limit) bool) {
+	for node := ls.head.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.limit) {
+			return
+		}
+	}
+}
+
+// Limits returns all the levels from the best price to the worst
+func (ls *levels) Limits() []*Limit {
+	limits := make([]*Limit, 0, ls.length)
+	ls.Each(func(limit *Limit) bool {
+		limits = append(limits, limit)
+		return true
+	})
+	return limits
+}
+
+// predecessors returns, for each height, the last node before price
+func (ls *levels) predecessors(price decimal.Decimal) [maxSkipLevel]*levelNode {
+	var update [maxSkipLevel]*levelNode
+
+	node := ls.head
+	for i := ls.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && ls.better(node.next[i].limit.Price, price) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	return update
+}
+
+func randomSkipHeight() int {
+	height := 1
+	for height < maxSkipLevel && rand.Intn(2) == 0 {
+		height++
+	}
+	return height
+}
@@ -1,48 +1,121 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
-	"sort"
+	"math"
 	"sync"
 	"time"
 
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
 	"github.com/sirupsen/logrus"
 )
 
 type Trade struct {
-	Price 		float64
-	Timestamp int64
-	Bid 		  bool
-	Size 		  float64
+	ID 						int64
+	Market 				string
+	Price 				decimal.Decimal
+	Timestamp 		int64
+	Bid 		  		bool // side of the taker
+	AggressorSide string // BID or ASK, the side of the taker
+	Size 		  		decimal.Decimal
+	MakerOrderID 	int64
+	TakerOrderID 	int64
+	MakerUserID 	int64
+	TakerUserID 	int64
 }
 
 type Match struct {
 	Ask        *Order
 	Bid        *Order
-	SizeFilled float64
-	Price      float64
+	SizeFilled decimal.Decimal
+	Price      decimal.Decimal
+	TradeID    int64
+	// Trade recorded for the match, with its attribution
+	Trade      *Trade
 }
 
+// Default price increment used when a post-only order gets repriced
+const DefaultTickSize = decimal.One / 100
+
+// Default size increment of the fills a budget can afford
+const DefaultLotSize = decimal.Decimal(1)
+
+var (
+	ErrPostOnlyWouldCross    = errors.New("post-only order would cross the book")
+	ErrEmptyBook             = errors.New("no liquidity on the opposite side of the book")
+	ErrInsufficientLiquidity = errors.New("not enough volume to fill the market order")
+	ErrInsufficientBudget    = errors.New("not enough budget to fill the market order")
+	ErrOrderNotResting       = errors.New("order is not resting in the book")
+	ErrOrderWouldCross       = errors.New("order would cross the book")
+)
+
+// How long a limit order stays active in the book
+type TimeInForce string
+
+const (
+	GoodTillCancel    TimeInForce = "GTC" // rests until filled or cancelled
+	ImmediateOrCancel TimeInForce = "IOC" // fills what it can, the rest is cancelled
+	FillOrKill        TimeInForce = "FOK" // fills entirely or not at all
+	GoodTillDate      TimeInForce = "GTD" // rests until ExpiresAt
+)
+
 type Order struct {
 	ID				int64
 	UserID  	int64
-	Size      float64
+	Size      decimal.Decimal
 	Bid       bool
 	Limit     *Limit
 	Timestamp int64
+	TimeInForce TimeInForce // empty means GTC
+	ExpiresAt   int64       // unix nano, only used by GTD orders
+	// A post-only order never takes liquidity, if it would cross the book
+	// it is rejected or, with PostOnlyReprice, moved one tick away from the opposite touch
+	PostOnly        bool
+	PostOnlyReprice bool
+	// An iceberg order only shows DisplaySize in the book, Size being the visible
+	// slice and HiddenSize the reserve used to refresh it once filled
+	DisplaySize decimal.Decimal
+	HiddenSize  decimal.Decimal
+	// Price collar of a market order, either as the worst acceptable price
+	// or in basis points away from the touch, 0 means no collar
+	WorstPrice     decimal.Decimal
+	MaxSlippageBps int64
+	// Most a market bid can spend in the quote asset, 0 means no limit.
+	// It stops matching once the next fill would go over it.
+	Budget decimal.Decimal
+	// What to do instead of matching an order of the same user
+	SelfTradePrevention SelfTradePrevention
+	// Matches against orders of the same user prevented while it was the taker
+	PreventedMatches []PreventedMatch
+	// Stop orders triggered by its trades, and by the trades of those in turn.
+	// Whatever they didn't fill is either resting in the book or cancelled.
+	ReleasedStops []*StopOrder
+
+	selfTradeCancelled bool
+
+	// Neighbours in the FIFO queue of its Limit
+	prev *Order
+	next *Order
 }
 
 type Orders []*Order
 
-func (o Orders) Len() int						{ return len(o) }
-func (o Orders) Swap(i, j int)			{ o[i], o[j] = o[j], o[i] }
-func (o Orders) Less(i, j int) bool	{ return o[i].Timestamp < o[j].Timestamp }
+// Limit order of a batch placed with PlaceRestingOrders
+type RestingOrder struct {
+	Book 	*Orderbook
+	Price decimal.Decimal
+	Order *Order
+}
+
+// In memory sequence of the orders created with NewOrder, an exchange
+// replaces the ID with one of its own persisted sequence
+var orderIDs = &IDGenerator{}
 
-func NewOrder(bid bool, size float64, userId int64) *Order {
+func NewOrder(bid bool, size decimal.Decimal, userId int64) *Order {
 	return &Order{
 		UserID: 	 userId,
-		ID: 			 int64(rand.Intn(1000000000000)),
+		ID: 			 orderIDs.MustNext(),
 		Size:      size,
 		Bid:       bid,
 		Timestamp: time.Now().UnixNano(),
@@ -50,7 +123,7 @@ func NewOrder(bid bool, size float64, userId int64) *Order {
 }
 
 func (o *Order) String() string {
-	return fmt.Sprintf("[size: %.2f]", o.Size)
+	return fmt.Sprintf("[size: %s]", o.Size)
 }
 
 func (o *Order) Type() string {
@@ -62,66 +135,158 @@ func (o *Order) Type() string {
 }
 
 func (o *Order) IsFilled() bool {
-	return o.Size == 0.0
+	return o.Size == 0 && o.HiddenSize == 0
 }
 
-// Bucket of different orders of different sizes from different sitting at a same price level
-type Limit struct {
-	Price       float64
-	Orders      Orders
-	TotalVolume float64
+func (o *Order) IsIceberg() bool {
+	return o.DisplaySize > 0
 }
 
-type Limits []*Limit
+// TotalSize is the size left to fill including the hidden reserve
+func (o *Order) TotalSize() decimal.Decimal {
+	return o.Size + o.HiddenSize
+}
 
-type ByBestAsk struct{ Limits }
+// splitDisplay moves everything above the display size of an iceberg to its reserve
+func (o *Order) splitDisplay() {
+	if !o.IsIceberg() || o.Size <= o.DisplaySize {
+		return
+	}
 
-func (a ByBestAsk) Len() int           { return len(a.Limits) }
-func (a ByBestAsk) Swap(i, j int)      { a.Limits[i], a.Limits[j] = a.Limits[j], a.Limits[i] }
-func (a ByBestAsk) Less(i, j int) bool { return a.Limits[i].Price < a.Limits[j].Price }
+	o.HiddenSize += o.Size - o.DisplaySize
+	o.Size = o.DisplaySize
+}
 
-type ByBestBid struct{ Limits }
+// refreshDisplay shows a new slice of an iceberg from its reserve,
+// the new slice gets a new time priority
+func (o *Order) refreshDisplay() decimal.Decimal {
+	slice := o.DisplaySize
+	if o.HiddenSize < slice {
+		slice = o.HiddenSize
+	}
+
+	o.Size = slice
+	o.HiddenSize -= slice
+	o.Timestamp = time.Now().UnixNano()
 
-func (b ByBestBid) Len() int           { return len(b.Limits) }
-func (b ByBestBid) Swap(i, j int)      { b.Limits[i], b.Limits[j] = b.Limits[j], b.Limits[i] }
-func (b ByBestBid) Less(i, j int) bool { return b.Limits[i].Price > b.Limits[j].Price }
+	return slice
+}
 
-func NewLimit(price float64) *Limit {
+// IsExpired reports whether a GTD order reached its expiry time at now (unix nano)
+func (o *Order) IsExpired(now int64) bool {
+	return o.TimeInForce == GoodTillDate && o.ExpiresAt <= now
+}
+
+// Bucket of different orders of different sizes from different sitting at a same price level
+// The orders are kept in a FIFO linked list, the oldest one being matched first.
+type Limit struct {
+	Price       decimal.Decimal
+	TotalVolume decimal.Decimal // includes the hidden volume
+	HiddenVolume decimal.Decimal
+
+	head  *Order
+	tail  *Order
+	count int
+}
+
+func NewLimit(price decimal.Decimal) *Limit {
 	return &Limit{
 		Price:  price,
-		Orders: []*Order{},
 	}
 }
 
+// Orders returns the orders of the level by time priority
+func (l *Limit) Orders() Orders {
+	orders := make(Orders, 0, l.count)
+	for o := l.head; o != nil; o = o.next {
+		orders = append(orders, o)
+	}
+	return orders
+}
+
+func (l *Limit) Len() int {
+	return l.count
+}
+
 func (l *Limit) AddOrder(o *Order) {
 	o.Limit = l
-	l.Orders = append(l.Orders, o)
-	l.TotalVolume += o.Size
+	l.push(o)
+	l.TotalVolume += o.TotalSize()
+	l.HiddenVolume += o.HiddenSize
+}
+
+// DisplayVolume is the volume visible in the book
+func (l *Limit) DisplayVolume() decimal.Decimal {
+	return l.TotalVolume - l.HiddenVolume
+}
+
+// reduceOrder takes size off a resting order without touching its time
+// priority, the iceberg reserve is reduced before the display slice
+func (l *Limit) reduceOrder(o *Order, size decimal.Decimal) {
+	hidden := size
+	if o.HiddenSize < hidden {
+		hidden = o.HiddenSize
+	}
+
+	o.HiddenSize -= hidden
+	o.Size -= size - hidden
+	l.HiddenVolume -= hidden
+	l.TotalVolume -= size
 }
 
 func (l *Limit) DeleteOrder(o *Order) {
-	for i := 0; i < len(l.Orders); i++ {
-		if l.Orders[i] == o {
-			l.Orders[i] = l.Orders[len(l.Orders)-1]
-			l.Orders = l.Orders[:len(l.Orders)-1]
-		}
+	if o.Limit != l {
+		return
 	}
 
+	l.unlink(o)
+
 	o.Limit = nil
-	l.TotalVolume -= o.Size
+	l.TotalVolume -= o.TotalSize()
+	l.HiddenVolume -= o.HiddenSize
+}
+
+// push appends o at the back of the queue
+func (l *Limit) push(o *Order) {
+	o.prev = l.tail
+	o.next = nil
 
-	sort.Sort(l.Orders)
+	if l.tail == nil {
+		l.head = o
+	} else {
+		l.tail.next = o
+	}
+	l.tail = o
+	l.count++
 }
 
-func (l *Limit) Fill(o *Order) []Match {
-	var (
-		matches        []Match
-		ordersToDelete []*Order
-	)
+func (l *Limit) unlink(o *Order) {
+	if o.prev == nil {
+		l.head = o.next
+	} else {
+		o.prev.next = o.next
+	}
 
-	for _, order := range l.Orders {
-		if o.IsFilled() {
-			break
+	if o.next == nil {
+		l.tail = o.prev
+	} else {
+		o.next.prev = o.prev
+	}
+
+	o.prev, o.next = nil, nil
+	l.count--
+}
+
+func (l *Limit) Fill(o *Order) []Match {
+	var matches []Match
+
+	order := l.head
+	for order != nil && !o.IsFilled() && !o.selfTradeCancelled {
+		if o.isSelfTrade(order) {
+			next := order.next
+			o.PreventedMatches = append(o.PreventedMatches, l.preventSelfTrade(order, o))
+			order = next
+			continue
 		}
 
 		match := l.fillOrder(order, o)
@@ -129,13 +294,23 @@ func (l *Limit) Fill(o *Order) []Match {
 
 		l.TotalVolume -= match.SizeFilled
 
-		if order.IsFilled() {
-			ordersToDelete = append(ordersToDelete, order)
+		if order.Size == 0 && order.HiddenSize > 0 {
+			// Iceberg slice is gone, the refreshed one goes to the back of the queue
+			l.HiddenVolume -= order.refreshDisplay()
+			if order != l.tail {
+				next := order.next
+				l.unlink(order)
+				l.push(order)
+				order = next
+			}
+			continue
 		}
-	}
 
-	for _, order := range ordersToDelete {
-		l.DeleteOrder(order)
+		next := order.next
+		if order.IsFilled() {
+			l.DeleteOrder(order)
+		}
+		order = next
 	}
 
 	return matches
@@ -145,7 +320,7 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 	var (
 		bid        *Order
 		ask        *Order
-		sizeFilled float64
+		sizeFilled decimal.Decimal
 	)
 
 	if a.Bid {
@@ -159,11 +334,11 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 	if a.Size >= b.Size {
 		a.Size -= b.Size
 		sizeFilled = b.Size
-		b.Size = 0.0
+		b.Size = 0
 	} else {
 		b.Size -= a.Size
 		sizeFilled = a.Size
-		a.Size = 0.0
+		a.Size = 0
 	}
 
 	return Match{
@@ -175,27 +350,48 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 }
 
 type Orderbook struct {
-	asks []*Limit
-	bids []*Limit
+	asks *levels
+	bids *levels
 
 	Trades []*Trade
 
 	mu 				sync.RWMutex
-	AskLimits map[float64]*Limit
-	BidLimits map[float64]*Limit
+	AskLimits map[decimal.Decimal]*Limit
+	BidLimits map[decimal.Decimal]*Limit
 
 	Orders map[int64]*Order
+
+	// Trigger book, pending stop orders are not visible in Asks() / Bids()
+	StopOrders map[int64]*StopOrder
+	buyStops   map[decimal.Decimal][]*StopOrder
+	sellStops  map[decimal.Decimal][]*StopOrder
+
+	TickSize decimal.Decimal
+	// Sizes a budget can afford are rounded down to a multiple of it
+	LotSize  decimal.Decimal
+
+	// Market the book trades, recorded on its trades
+	Market string
+
+	// Sequence of the trade IDs, can be shared by the orderbooks of an exchange
+	TradeIDs *IDGenerator
 }
 
 func NewOrderbook() *Orderbook {
 	return &Orderbook{
+		TickSize:   DefaultTickSize,
+		LotSize:    DefaultLotSize,
+		TradeIDs:   &IDGenerator{},
 		mu: 				sync.RWMutex{},
-		asks:      	[]*Limit{},
-		bids:      	[]*Limit{},
-		AskLimits: 	make(map[float64]*Limit),
-		BidLimits: 	make(map[float64]*Limit),
+		asks:      	newAskLevels(),
+		bids:      	newBidLevels(),
+		AskLimits: 	make(map[decimal.Decimal]*Limit),
+		BidLimits: 	make(map[decimal.Decimal]*Limit),
 		Orders:    	make(map[int64]*Order),
 		Trades: 	  []*Trade{},
+		StopOrders: make(map[int64]*StopOrder),
+		buyStops:   make(map[decimal.Decimal][]*StopOrder),
+		sellStops:  make(map[decimal.Decimal][]*StopOrder),
 	}
 }
 
@@ -206,61 +402,147 @@ func NewOrderbook() *Orderbook {
 // If the exchange is empty, it doesn't work.
 
 // Market order are always filled at the best available price
-func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
-	matches := []Match{}
+// The returned matches also include the ones of the stop orders it triggered,
+// which are added to its ReleasedStops.
+// When there is not enough volume to fill it, the time in force of the order
+// decides: an IOC order fills what is available and the rest is cancelled,
+// otherwise (FOK, the default) it is rejected with ErrInsufficientLiquidity,
+// or ErrInsufficientBudget when its budget doesn't cover the volume.
+// With a price collar only the levels within the collar count as available.
+func (ob *Orderbook) PlaceMarketOrder(o *Order) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
+	availableVolume := ob.BidTotalVolume()
 	if o.Bid {
-		if o.Size > ob.AskTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
+		availableVolume = ob.AskTotalVolume()
+	}
+
+	if availableVolume == 0 {
+		return nil, ErrEmptyBook
+	}
+
+	crosses := ob.withinCollar(o)
+
+	// Only counts what the order can take, within its collar and budget and
+	// without the orders of the same user when it prevents self trades
+	availableVolume, overBudget := ob.fillableVolume(o, crosses)
+
+	if o.Size > availableVolume && o.TimeInForce != ImmediateOrCancel {
+		err := ErrInsufficientLiquidity
+		if overBudget {
+			err = ErrInsufficientBudget
 		}
+		return nil, fmt.Errorf("%w [available: %s] [size: %s]", err, availableVolume, o.Size)
+	}
 
-		for _, limit := range ob.Asks() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
+	fromTrade := len(ob.Trades)
+	matches := ob.match(o, crosses)
 
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(false, limit)
-			}
+	if len(matches) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
+			"cancelledSize": o.Size,
+		}).Info("Placed market order")
+	}
+
+	return append(matches, ob.releaseStops(o, fromTrade)...), nil
+}
+
+// A limit order first takes liquidity from the opposite side of the book
+// for as long as the best price crosses its own, only the unfilled
+// remainder will sit in the book at the given price.
+// IOC orders never rest and FOK orders are only matched when they can be
+// filled entirely, in both cases the order is not in the book afterwards.
+// The returned matches also include the ones of the stop orders it triggered,
+// which are added to its ReleasedStops.
+func (ob *Orderbook) PlaceLimitOrder(price decimal.Decimal, o *Order) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	fromTrade := len(ob.Trades)
+	matches, err := ob.placeLimitOrder(price, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(matches, ob.releaseStops(o, fromTrade)...), nil
+}
 
+// PlaceRestingOrders places a batch of limit orders which all rest in their
+// book without trading, or none of them. An order which would cross its book,
+// including the orders placed before it in the batch, gets the whole batch
+// removed again; its index in the batch is returned with the error.
+// The books, each given once, are locked at once in the order given, which has
+// to be the same for every caller, so nothing trades against the batch before
+// it is complete.
+func PlaceRestingOrders(books []*Orderbook, orders []RestingOrder) (int, error) {
+	for _, ob := range books {
+		ob.mu.Lock()
+		defer ob.mu.Unlock()
+	}
+
+	for i, r := range orders {
+		o := r.Order
+		var err error
+		if o.TimeInForce == ImmediateOrCancel || o.TimeInForce == FillOrKill {
+			err = fmt.Errorf("%s order can't rest in the book", o.TimeInForce)
+		} else if r.Book.crosses(r.Price, o.Bid) {
+			err = ErrOrderWouldCross
 		}
-	} else {
-		if o.Size > ob.BidTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.BidTotalVolume(), o.Size))
+		if err == nil {
+			_, err = r.Book.placeLimitOrder(r.Price, o)
 		}
 
-		for _, limit := range ob.Bids() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
-
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(true, limit)
+		if err != nil {
+			for _, placed := range orders[:i] {
+				placed.Book.CancelOrder(placed.Order)
 			}
+			return i, err
 		}
 	}
 
-	for _, match := range matches {
-		trade := &Trade{
-			Price:     match.Price,
-			Size:      match.SizeFilled,
-			Bid:       o.Bid,
-			Timestamp: time.Now().UnixNano(),
+	return 0, nil
+}
+
+func (ob *Orderbook) placeLimitOrder(price decimal.Decimal, o *Order) ([]Match, error) {
+	var limit *Limit
+
+	// An iceberg takes liquidity with its full size, it is only split
+	// into a display slice and a reserve when resting in the book
+	o.Size, o.HiddenSize = o.TotalSize(), 0
+
+	if o.PostOnly {
+		postOnlyPrice, err := ob.postOnlyPrice(price, o)
+		if err != nil {
+			return nil, err
 		}
+		price = postOnlyPrice
+	}
 
-		ob.Trades = append(ob.Trades, trade)
+	crosses := func(limitPrice decimal.Decimal) bool {
+		if o.Bid {
+			return limitPrice <= price
+		}
+		return limitPrice >= price
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
-	}).Info("Placed market order")
+	if fillable, _ := ob.fillableVolume(o, crosses); o.TimeInForce == FillOrKill && fillable < o.Size {
+		logrus.WithFields(logrus.Fields{
+			"price": price,
+			"type": o.Type(),
+			"size": o.Size,
+			"userID": o.UserID,
+		}).Info("Killed FOK order")
 
-	return matches
-}
+		return []Match{}, nil
+	}
 
-func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
-	var limit *Limit
+	matches := ob.match(o, crosses)
 
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
+	if o.IsFilled() || o.selfTradeCancelled || o.TimeInForce == ImmediateOrCancel || o.TimeInForce == FillOrKill {
+		return matches, nil
+	}
 
 	if o.Bid {
 		limit = ob.BidLimits[price]
@@ -272,10 +554,10 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		limit = NewLimit(price)
 
 		if o.Bid {
-			ob.bids = append(ob.bids, limit)
+			ob.bids.Insert(limit)
 			ob.BidLimits[price] = limit
 		} else {
-			ob.asks = append(ob.asks, limit)
+			ob.asks.Insert(limit)
 			ob.AskLimits[price] = limit
 		}
 	}
@@ -287,30 +569,298 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		"userID": o.UserID,
 	}).Info("New limit order")
 
+	o.splitDisplay()
 	ob.Orders[o.ID] = o
 	limit.AddOrder(o)
+
+	return matches, nil
 }
 
-func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
+// postOnlyPrice returns the price a post-only order can rest at without
+// taking liquidity
+func (ob *Orderbook) postOnlyPrice(price decimal.Decimal, o *Order) (decimal.Decimal, error) {
+	if !ob.crosses(price, o.Bid) {
+		return price, nil
+	}
+
+	if o.PostOnlyReprice {
+		if o.Bid {
+			return ob.BestAsk().Price - ob.TickSize, nil
+		}
+		return ob.BestBid().Price + ob.TickSize, nil
+	}
+
+	return 0, ErrPostOnlyWouldCross
+}
+
+// crosses reports whether an order at price would take liquidity from the
+// opposite side of the book
+func (ob *Orderbook) crosses(price decimal.Decimal, bid bool) bool {
 	if bid {
-		delete(ob.BidLimits, l.Price)
-		for i := 0; i < len(ob.bids); i++ {
-			if ob.bids[i] == l {
-				ob.bids[i] = ob.bids[len(ob.bids)-1]
-				ob.bids = ob.bids[:len(ob.bids)-1]
+		bestAsk := ob.BestAsk()
+		return bestAsk != nil && price >= bestAsk.Price
+	}
+
+	bestBid := ob.BestBid()
+	return bestBid != nil && price <= bestBid.Price
+}
+
+// match fills o against the opposite side of the book, starting from the
+// best price level and walking down as long as crosses returns true.
+func (ob *Orderbook) match(o *Order, crosses func(price decimal.Decimal) bool) []Match {
+	matches := []Match{}
+
+	side := ob.bids
+	if o.Bid {
+		side = ob.asks
+	}
+
+	spent := decimal.Zero
+	for !o.IsFilled() && !o.selfTradeCancelled {
+		limit := side.Best()
+		if limit == nil || !crosses(limit.Price) {
+			break
+		}
+
+		// The part of the order its budget can't afford at this level sits out
+		// of the fill, matching stops once the budget can't afford anything
+		unaffordable := decimal.Zero
+		if o.Budget > 0 {
+			if affordable := ob.affordable(o.Budget-spent, limit.Price); affordable < o.Size {
+				unaffordable = o.Size - affordable
+				o.Size = affordable
+			}
+			if o.Size == 0 {
+				o.Size = unaffordable
+				break
 			}
 		}
-	} else {
-		delete(ob.AskLimits, l.Price)
-		for i := 0; i < len(ob.asks); i++ {
-			if ob.asks[i] == l {
-				ob.asks[i] = ob.asks[len(ob.asks)-1]
-				ob.asks = ob.asks[:len(ob.asks)-1]
+
+		fromPrevented := len(o.PreventedMatches)
+		limitMatches := limit.Fill(o)
+		matches = append(matches, limitMatches...)
+
+		for _, match := range limitMatches {
+			spent += match.SizeFilled.Mul(match.Price)
+		}
+		o.Size += unaffordable
+
+		for _, pm := range o.PreventedMatches[fromPrevented:] {
+			if pm.MakerCancelled {
+				delete(ob.Orders, pm.Maker.ID)
+			}
+		}
+
+		for _, match := range limitMatches {
+			maker := match.Ask
+			if !o.Bid {
+				maker = match.Bid
+			}
+			if maker.IsFilled() {
+				delete(ob.Orders, maker.ID)
+			}
+		}
+
+		if limit.Len() == 0 {
+			ob.clearLimit(!o.Bid, limit)
+		}
+	}
+
+	for i, match := range matches {
+		maker := match.Ask
+		if !o.Bid {
+			maker = match.Bid
+		}
+
+		tradeID, err := ob.TradeIDs.Next()
+		if err != nil {
+			logrus.WithError(err).Error("Failed to persist the trade ID sequence")
+		}
+		matches[i].TradeID = tradeID
+
+		trade := &Trade{
+			ID: 					tradeID,
+			Market: 			ob.Market,
+			Price:     		match.Price,
+			Size:      		match.SizeFilled,
+			Bid:       		o.Bid,
+			AggressorSide: o.Type(),
+			Timestamp: 		time.Now().UnixNano(),
+			MakerOrderID: maker.ID,
+			TakerOrderID: o.ID,
+			MakerUserID: 	maker.UserID,
+			TakerUserID: 	o.UserID,
+		}
+
+		matches[i].Trade = trade
+		ob.Trades = append(ob.Trades, trade)
+	}
+
+	return matches
+}
+
+// priceCollar returns the worst price a market order can be filled at,
+// 0 when it has no collar
+func (ob *Orderbook) priceCollar(o *Order) decimal.Decimal {
+	if o.WorstPrice != 0 || o.MaxSlippageBps == 0 {
+		return o.WorstPrice
+	}
+
+	if o.Bid {
+		if bestAsk := ob.BestAsk(); bestAsk != nil {
+			return bestAsk.Price.MulDiv(10_000+o.MaxSlippageBps, 10_000)
+		}
+	} else if bestBid := ob.BestBid(); bestBid != nil {
+		return bestBid.Price.MulDiv(10_000-o.MaxSlippageBps, 10_000)
+	}
+
+	return decimal.Zero
+}
+
+// withinCollar returns whether a price level is within the collar of a
+// market order, every level is without a collar
+func (ob *Orderbook) withinCollar(o *Order) func(price decimal.Decimal) bool {
+	collar := ob.priceCollar(o)
+
+	return func(price decimal.Decimal) bool {
+		if collar == 0 {
+			return true
+		}
+		if o.Bid {
+			return price <= collar
+		}
+		return price >= collar
+	}
+}
+
+// affordable returns the size a budget can pay for at price, rounded down
+// to the lot size
+func (ob *Orderbook) affordable(budget, price decimal.Decimal) decimal.Decimal {
+	size, err := budget.CheckedMulDiv(int64(decimal.One), int64(price))
+	if err != nil {
+		// More than a Decimal can hold, so more than any order
+		return decimal.Decimal(math.MaxInt64)
+	}
+
+	lot := ob.LotSize
+	if lot <= 0 {
+		lot = DefaultLotSize
+	}
+
+	return size - size%lot
+}
+
+// fillableVolume returns how much of o would trade against the opposite side
+// of the book at the price levels accepted by crosses, and whether the budget
+// of o is what limits it. With a self-trade prevention, the resting orders of
+// the same user never trade with o and unless they are the ones cancelled,
+// they cut o short: its remainder is cancelled or, with DecrementAndCancel,
+// decremented by their size.
+func (ob *Orderbook) fillableVolume(o *Order, crosses func(price decimal.Decimal) bool) (decimal.Decimal, bool) {
+	filled := decimal.Zero
+	size := o.TotalSize()
+
+	type levelVolume struct {
+		price 	decimal.Decimal
+		volume 	decimal.Decimal
+	}
+	levels := []levelVolume{}
+
+	side := ob.bids
+	if o.Bid {
+		side = ob.asks
+	}
+
+	// Levels are walked from the best price, the first one that doesn't cross ends it
+	side.Each(func(limit *Limit) bool {
+		if !crosses(limit.Price) {
+			return false
+		}
+
+		// Once its slice is filled, an iceberg goes to the back of the queue
+		// behind the orders of the user, so only the slice counts before a cut
+		fromLevel, display := filled, decimal.Zero
+		for order := limit.head; order != nil && filled < size; order = order.next {
+			if !o.isSelfTrade(order) {
+				filled += order.TotalSize()
+				display += order.Size
+				continue
 			}
+
+			switch {
+			case o.SelfTradePrevention == CancelOldest:
+				continue
+			case o.SelfTradePrevention == DecrementAndCancel && order.TotalSize() < size-filled:
+				size -= order.TotalSize()
+				continue
+			}
+
+			filled = fromLevel + display
+			size = filled
 		}
+		levels = append(levels, levelVolume{price: limit.Price, volume: filled - fromLevel})
+
+		return filled < size
+	})
+
+	if filled > size {
+		filled = size
+	}
+	if o.Budget == 0 {
+		return filled, false
 	}
 
-	fmt.Printf("Clearing limit  price level [%.2f] \n", l.Price)
+	// What the budget pays for, best price first
+	affordable, budget := decimal.Zero, o.Budget
+	for _, level := range levels {
+		volume := min(level.volume, filled-affordable)
+		if canAfford := ob.affordable(budget, level.price); canAfford < volume {
+			return affordable + canAfford, true
+		}
+		affordable += volume
+		budget -= volume.Mul(level.price)
+	}
+
+	return affordable, false
+}
+
+// EstimateCost returns the notional a bid (or ask) market order of size
+// would trade against the current book, best price first. Only the part
+// of size the book can fill counts.
+func (ob *Orderbook) EstimateCost(bid bool, size decimal.Decimal) decimal.Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	side := ob.bids
+	if bid {
+		side = ob.asks
+	}
+
+	cost := decimal.Zero
+	side.Each(func(limit *Limit) bool {
+		fill := limit.TotalVolume
+		if fill > size {
+			fill = size
+		}
+		cost += fill.Mul(limit.Price)
+		size -= fill
+
+		return size > 0
+	})
+
+	return cost
+}
+
+func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
+	if bid {
+		delete(ob.BidLimits, l.Price)
+		ob.bids.Remove(l.Price)
+	} else {
+		delete(ob.AskLimits, l.Price)
+		ob.asks.Remove(l.Price)
+	}
+
+	fmt.Printf("Clearing limit  price level [%s] \n", l.Price)
 }
 
 func (ob *Orderbook) CancelOrder(o *Order) {
@@ -318,37 +868,232 @@ func (ob *Orderbook) CancelOrder(o *Order) {
 	limit.DeleteOrder(o)
 	delete(ob.Orders, o.ID)
 
-	if len(limit.Orders) == 0 {
+	if limit.Len() == 0 {
 		ob.clearLimit(o.Bid, limit)
 	}
 }
 
-func (ob *Orderbook) BidTotalVolume() float64 {
-	totalVolume := 0.0
+// Cancel cancels the resting or pending stop order with the given ID and
+// returns it
+func (ob *Orderbook) Cancel(id int64) (*Order, bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
-	for i := 0; i < len(ob.bids); i++ {
-		totalVolume += ob.bids[i].TotalVolume
+	if stop, ok := ob.StopOrders[id]; ok {
+		ob.removeStop(stop)
+		return stop.Order, true
 	}
 
-	return totalVolume
+	o, ok := ob.Orders[id]
+	if !ok {
+		return nil, false
+	}
+	ob.CancelOrder(o)
+
+	return o, true
+}
+
+// CancelOrders cancels at once every resting and pending stop order for
+// which match returns true, nothing can be matched against them meanwhile.
+// It returns the cancelled orders.
+func (ob *Orderbook) CancelOrders(match func(o *Order) bool) []*Order {
+	return CancelOrdersIn([]*Orderbook{ob}, match)
+}
+
+// CancelOrdersIn is CancelOrders over several books at once, none of them is
+// unlocked before the orders of every book are cancelled. The books are locked
+// in the order given, which has to be the same for every caller.
+func CancelOrdersIn(books []*Orderbook, match func(o *Order) bool) []*Order {
+	for _, ob := range books {
+		ob.mu.Lock()
+		defer ob.mu.Unlock()
+	}
+
+	cancelled := []*Order{}
+	for _, ob := range books {
+		cancelled = append(cancelled, ob.cancelOrders(match)...)
+	}
+
+	return cancelled
+}
+
+func (ob *Orderbook) cancelOrders(match func(o *Order) bool) []*Order {
+	cancelled := []*Order{}
+	for _, order := range ob.Orders {
+		if match(order) {
+			cancelled = append(cancelled, order)
+		}
+	}
+	for _, order := range cancelled {
+		ob.CancelOrder(order)
+	}
+
+	for _, stop := range ob.StopOrders {
+		if match(stop.Order) {
+			ob.removeStop(stop)
+			cancelled = append(cancelled, stop.Order)
+		}
+	}
+
+	return cancelled
+}
+
+// Order returns a resting order of the book
+func (ob *Orderbook) Order(id int64) (*Order, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	o, ok := ob.Orders[id]
+	return o, ok
+}
+
+// AmendOrder changes the price and the remaining size of a resting order,
+// a zero price or size keeps the current one. Both are resolved under the
+// book lock, then passed to check which can still reject the amend before
+// anything changes, e.g. when the funds for the new size are missing.
+// A size decrease at the same price keeps the time priority of the order,
+// a price change or a size increase sends it to the back of the queue of
+// its new price, where it is matched first if it crosses the book.
+// The returned matches also include the ones of the stop orders it triggered,
+// which are added to its ReleasedStops.
+func (ob *Orderbook) AmendOrder(o *Order, price, size decimal.Decimal, check func(price, size decimal.Decimal) error) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	limit := o.Limit
+	if limit == nil {
+		return nil, ErrOrderNotResting
+	}
+	if price == 0 {
+		price = limit.Price
+	}
+	if size == 0 {
+		size = o.TotalSize()
+	}
+	if size <= 0 || price <= 0 {
+		return nil, fmt.Errorf("invalid amended price and size: %s %s", price, size)
+	}
+
+	reduce := price == limit.Price && size <= o.TotalSize()
+
+	// Checked before leaving the queue, so a rejected amend keeps the order as it was
+	if !reduce && o.PostOnly {
+		if _, err := ob.postOnlyPrice(price, o); err != nil {
+			return nil, err
+		}
+	}
+
+	if check != nil {
+		if err := check(price, size); err != nil {
+			return nil, err
+		}
+	}
+
+	if reduce {
+		limit.reduceOrder(o, o.TotalSize()-size)
+		return []Match{}, nil
+	}
+
+	limit.DeleteOrder(o)
+	delete(ob.Orders, o.ID)
+	if limit.Len() == 0 {
+		ob.clearLimit(o.Bid, limit)
+	}
+
+	o.Size, o.HiddenSize = size, 0
+	o.Timestamp = time.Now().UnixNano()
+
+	fromTrade := len(ob.Trades)
+	matches, err := ob.placeLimitOrder(price, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(matches, ob.releaseStops(o, fromTrade)...), nil
 }
 
-func (ob *Orderbook) AskTotalVolume() float64 {
-	totalVolume := 0.0
+// ExpireOrders cancels every GTD order that expired at now (unix nano)
+// and returns them
+func (ob *Orderbook) ExpireOrders(now int64) []*Order {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
-	for i := 0; i < len(ob.asks); i++ {
-		totalVolume += ob.asks[i].TotalVolume
+	expired := []*Order{}
+	for _, order := range ob.Orders {
+		if order.IsExpired(now) {
+			expired = append(expired, order)
+		}
 	}
 
+	for _, order := range expired {
+		ob.CancelOrder(order)
+	}
+
+	return expired
+}
+
+// BidDisplayVolume is the bid volume visible in the book, without the iceberg reserves
+func (ob *Orderbook) BidDisplayVolume() decimal.Decimal {
+	return sumVolume(ob.bids, (*Limit).DisplayVolume)
+}
+
+// AskDisplayVolume is the ask volume visible in the book, without the iceberg reserves
+func (ob *Orderbook) AskDisplayVolume() decimal.Decimal {
+	return sumVolume(ob.asks, (*Limit).DisplayVolume)
+}
+
+func (ob *Orderbook) BidTotalVolume() decimal.Decimal {
+	return sumVolume(ob.bids, func(l *Limit) decimal.Decimal { return l.TotalVolume })
+}
+
+func (ob *Orderbook) AskTotalVolume() decimal.Decimal {
+	return sumVolume(ob.asks, func(l *Limit) decimal.Decimal { return l.TotalVolume })
+}
+
+func sumVolume(side *levels, volume func(l *Limit) decimal.Decimal) decimal.Decimal {
+	totalVolume := decimal.Zero
+
+	side.Each(func(limit *Limit) bool {
+		totalVolume += volume(limit)
+		return true
+	})
+
 	return totalVolume
 }
 
+// BestAsk returns the lowest ask level, nil if there is none
+func (ob *Orderbook) BestAsk() *Limit {
+	return ob.asks.Best()
+}
+
+// BestBid returns the highest bid level, nil if there is none
+func (ob *Orderbook) BestBid() *Limit {
+	return ob.bids.Best()
+}
+
+// BestPrice returns the best bid (or ask) price, false if that side is
+// empty. Unlike BestBid and BestAsk it is safe while orders are matched.
+func (ob *Orderbook) BestPrice(bid bool) (decimal.Decimal, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	best := ob.asks.Best()
+	if bid {
+		best = ob.bids.Best()
+	}
+	if best == nil {
+		return decimal.Zero, false
+	}
+
+	return best.Price, true
+}
+
+// Asks returns the ask levels, best price first
 func (ob *Orderbook) Asks() []*Limit {
-	sort.Sort(ByBestAsk{ob.asks})
-	return ob.asks
+	return ob.asks.Limits()
 }
 
+// Bids returns the bid levels, best price first
 func (ob *Orderbook) Bids() []*Limit {
-	sort.Sort(ByBestBid{ob.bids})
-	return ob.bids
+	return ob.bids.Limits()
 }
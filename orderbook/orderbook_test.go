@@ -1,17 +1,23 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
 
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestLimit(t *testing.T) {
-	l := NewLimit(10_000)
-	buyOrderA := NewOrder(true, 1, 0)
-	buyOrderB := NewOrder(true, 2, 0)
-	buyOrderC := NewOrder(true, 3, 0)
+	l := NewLimit(10_000 * decimal.One)
+	buyOrderA := NewOrder(true, 1 * decimal.One, 0)
+	buyOrderB := NewOrder(true, 2 * decimal.One, 0)
+	buyOrderC := NewOrder(true, 3 * decimal.One, 0)
 
 	l.AddOrder(buyOrderA)
 	l.AddOrder(buyOrderB)
@@ -19,67 +25,120 @@ func TestLimit(t *testing.T) {
 
 	l.DeleteOrder(buyOrderB)
 
-	assert.Equal(t, len(l.Orders), 2)
+	assert.Equal(t, l.Len(), 2)
 }
 
 func TestPlaceLimitOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellOrder := NewOrder(false, 100, 0)
-	sellOrderb := NewOrder(false, 100, 0)
-	buyOrder := NewOrder(true, 2000, 0)
-	ob.PlaceLimitOrder(10_000, sellOrder)
-	ob.PlaceLimitOrder(9_000, buyOrder)
-	ob.PlaceLimitOrder(9_000, sellOrderb)
+	sellOrder := NewOrder(false, 100 * decimal.One, 0)
+	sellOrderb := NewOrder(false, 100 * decimal.One, 0)
+	buyOrder := NewOrder(true, 2000 * decimal.One, 0)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
+	ob.PlaceLimitOrder(9_000 * decimal.One, buyOrder)
+	ob.PlaceLimitOrder(9_500 * decimal.One, sellOrderb)
 
 	assert.Equal(t, len(ob.Orders), 3)
 	assert.Equal(t, ob.Orders[sellOrder.ID], sellOrder)
 	assert.Equal(t, ob.Orders[sellOrderb.ID], sellOrderb)
 
-	assert.Equal(t, len(ob.asks), 2)
-	assert.Equal(t, len(ob.bids), 1)
+	assert.Equal(t, ob.asks.Len(), 2)
+	assert.Equal(t, ob.bids.Len(), 1)
+}
+
+func TestPlaceLimitOrderCrossing(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrderA := NewOrder(false, 5 * decimal.One, 0)
+	sellOrderB := NewOrder(false, 10 * decimal.One, 0)
+	sellOrderC := NewOrder(false, 10 * decimal.One, 0)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrderA)
+	ob.PlaceLimitOrder(10_100 * decimal.One, sellOrderB)
+	ob.PlaceLimitOrder(10_200 * decimal.One, sellOrderC)
+
+	buyOrder := NewOrder(true, 20 * decimal.One, 1)
+	matches, err := ob.PlaceLimitOrder(10_100 * decimal.One, buyOrder)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, matches[0].Price, 10_000 * decimal.One)
+	assert.Equal(t, matches[0].SizeFilled, 5 * decimal.One)
+	assert.Equal(t, matches[1].Price, 10_100 * decimal.One)
+	assert.Equal(t, matches[1].SizeFilled, 10 * decimal.One)
+	assert.Equal(t, len(ob.Trades), 2)
+
+	// Only the remainder rests in the book at the limit price
+	assert.Equal(t, buyOrder.Size, 5 * decimal.One)
+	assert.Equal(t, ob.BidTotalVolume(), 5 * decimal.One)
+	assert.Equal(t, ob.Bids()[0].Price, 10_100 * decimal.One)
+	assert.Equal(t, ob.AskTotalVolume(), 10 * decimal.One)
+	assert.Equal(t, ob.asks.Len(), 1)
+
+	_, ok := ob.Orders[sellOrderA.ID]
+	assert.Equal(t, ok, false)
+	assert.Equal(t, ob.Orders[buyOrder.ID], buyOrder)
+}
+
+func TestPlaceLimitOrderFullyFilled(t *testing.T) {
+	ob := NewOrderbook()
+
+	buyOrder := NewOrder(true, 10 * decimal.One, 0)
+	ob.PlaceLimitOrder(10_000 * decimal.One, buyOrder)
+
+	sellOrder := NewOrder(false, 10 * decimal.One, 1)
+	matches, err := ob.PlaceLimitOrder(9_000 * decimal.One, sellOrder)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].Price, 10_000 * decimal.One)
+	assert.Equal(t, sellOrder.IsFilled(), true)
+	assert.Equal(t, ob.asks.Len(), 0)
+	assert.Equal(t, ob.bids.Len(), 0)
+	assert.Equal(t, len(ob.Orders), 0)
 }
 
 func TestPlaceMarketOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellOrder := NewOrder(false, 20, 0)
-	ob.PlaceLimitOrder(10_000, sellOrder)
+	sellOrder := NewOrder(false, 20 * decimal.One, 0)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
 
-	buyOrder := NewOrder(true, 10, 0)
-	matches := ob.PlaceMarketOrder(buyOrder)
+	buyOrder := NewOrder(true, 10 * decimal.One, 0)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert.Nil(t, err)
 
 	assert.Equal(t, len(matches), 1)
-	assert.Equal(t, len(ob.asks), 1)
-	assert.Equal(t, ob.AskTotalVolume(), 10.0)
+	assert.Equal(t, ob.asks.Len(), 1)
+	assert.Equal(t, ob.AskTotalVolume(), 10 * decimal.One)
 	assert.Equal(t, matches[0].Ask, sellOrder)
 	assert.Equal(t, matches[0].Bid, buyOrder)
-	assert.Equal(t, matches[0].SizeFilled, 10.0)
-	assert.Equal(t, matches[0].Price, 10_000.0)
+	assert.Equal(t, matches[0].SizeFilled, 10 * decimal.One)
+	assert.Equal(t, matches[0].Price, 10_000 * decimal.One)
 	assert.Equal(t, buyOrder.IsFilled(), true)
 }
 
 func TestPlaceMarketOrderMultiFilled(t *testing.T) {
 	ob := NewOrderbook()
 
-	buyOrderA := NewOrder(true, 5, 0)
-	buyOrderB := NewOrder(true, 8, 0)
-	buyOrderC := NewOrder(true, 10, 0)
-	buyOrderD := NewOrder(true, 1, 0)
+	buyOrderA := NewOrder(true, 5 * decimal.One, 0)
+	buyOrderB := NewOrder(true, 8 * decimal.One, 0)
+	buyOrderC := NewOrder(true, 10 * decimal.One, 0)
+	buyOrderD := NewOrder(true, 1 * decimal.One, 0)
 
-	ob.PlaceLimitOrder(5_000, buyOrderC)
-	ob.PlaceLimitOrder(5_000, buyOrderD)
-	ob.PlaceLimitOrder(9_000, buyOrderB)
-	ob.PlaceLimitOrder(10_000, buyOrderA)
+	ob.PlaceLimitOrder(5_000 * decimal.One, buyOrderC)
+	ob.PlaceLimitOrder(5_000 * decimal.One, buyOrderD)
+	ob.PlaceLimitOrder(9_000 * decimal.One, buyOrderB)
+	ob.PlaceLimitOrder(10_000 * decimal.One, buyOrderA)
 
-	assert.Equal(t, ob.BidTotalVolume(), 24.0)
+	assert.Equal(t, ob.BidTotalVolume(), 24 * decimal.One)
 
-	sellOrder := NewOrder(false, 20, 0)
-	matches := ob.PlaceMarketOrder(sellOrder)
+	sellOrder := NewOrder(false, 20 * decimal.One, 0)
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+	assert.Nil(t, err)
 
-	assert.Equal(t, ob.BidTotalVolume(), 4.0)
+	assert.Equal(t, ob.BidTotalVolume(), 4 * decimal.One)
 	assert.Equal(t, len(matches), 3)
-	assert.Equal(t, len(ob.bids), 1)
+	assert.Equal(t, ob.bids.Len(), 1)
 
 	fmt.Printf("Matches: %v\n", matches)
 }
@@ -87,13 +146,14 @@ func TestPlaceMarketOrderMultiFilled(t *testing.T) {
 func TestLastMarketTrades(t *testing.T) {
 	ob := NewOrderbook()
 
-	price := 10_000.0
+	price := 10_000 * decimal.One
 
-	sellOrder := NewOrder(false, 10, 0)
+	sellOrder := NewOrder(false, 10 * decimal.One, 0)
 	ob.PlaceLimitOrder(price, sellOrder)
 
-	marketOrder := NewOrder(true, 10, 0)
-	matches := ob.PlaceMarketOrder(marketOrder)
+	marketOrder := NewOrder(true, 10 * decimal.One, 0)
+	matches, err := ob.PlaceMarketOrder(marketOrder)
+	assert.Nil(t, err)
 
 	trade := ob.Trades[0]
 	match := matches[0]
@@ -109,16 +169,16 @@ func TestLastMarketTrades(t *testing.T) {
 func TestCancelOrderBid(t *testing.T) {
 	ob := NewOrderbook()
 
-	price := 10_000.0
+	price := 10_000 * decimal.One
 
-	buyOrder := NewOrder(true, 20, 0)
+	buyOrder := NewOrder(true, 20 * decimal.One, 0)
 	ob.PlaceLimitOrder(price, buyOrder)
 
-	assert.Equal(t, ob.BidTotalVolume(), 20.0)
+	assert.Equal(t, ob.BidTotalVolume(), 20 * decimal.One)
 
 	ob.CancelOrder(buyOrder)
 
-	assert.Equal(t, ob.BidTotalVolume(), 0.0)
+	assert.Equal(t, ob.BidTotalVolume(), decimal.Zero)
 
 	_, ok := ob.Orders[buyOrder.ID]
 	assert.Equal(t, ok, false)
@@ -131,16 +191,16 @@ func TestCancelOrderBid(t *testing.T) {
 func TestCancelOrderAsk(t *testing.T) {
 	ob := NewOrderbook()
 
-	price := 10_000.0
+	price := 10_000 * decimal.One
 
-	sellOrder := NewOrder(false, 20, 0)
+	sellOrder := NewOrder(false, 20 * decimal.One, 0)
 	ob.PlaceLimitOrder(price, sellOrder)
 
-	assert.Equal(t, ob.AskTotalVolume(), 20.0)
+	assert.Equal(t, ob.AskTotalVolume(), 20 * decimal.One)
 
 	ob.CancelOrder(sellOrder)
 
-	assert.Equal(t, ob.AskTotalVolume(), 0.0)
+	assert.Equal(t, ob.AskTotalVolume(), decimal.Zero)
 
 	_, ok := ob.Orders[sellOrder.ID]
 	assert.Equal(t, ok, false)
@@ -149,3 +209,1003 @@ func TestCancelOrderAsk(t *testing.T) {
 
 	assert.Equal(t, ok, false)
 }
+
+func TestPlaceLimitOrderIOC(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 5 * decimal.One, 0)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
+
+	buyOrder := NewOrder(true, 8 * decimal.One, 1)
+	buyOrder.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceLimitOrder(10_000 * decimal.One, buyOrder)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].SizeFilled, 5 * decimal.One)
+	assert.Equal(t, buyOrder.Size, 3 * decimal.One)
+	assert.Nil(t, buyOrder.Limit)
+	assert.Equal(t, ob.bids.Len(), 0)
+	assert.Equal(t, len(ob.Orders), 0)
+}
+
+func TestPlaceLimitOrderFOK(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrderA := NewOrder(false, 5 * decimal.One, 0)
+	sellOrderB := NewOrder(false, 5 * decimal.One, 0)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrderA)
+	ob.PlaceLimitOrder(10_100 * decimal.One, sellOrderB)
+
+	// Not enough volume at or below 10_000, nothing gets filled
+	killedOrder := NewOrder(true, 8 * decimal.One, 1)
+	killedOrder.TimeInForce = FillOrKill
+	matches, err := ob.PlaceLimitOrder(10_000 * decimal.One, killedOrder)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, killedOrder.Size, 8 * decimal.One)
+	assert.Nil(t, killedOrder.Limit)
+	assert.Equal(t, ob.AskTotalVolume(), 10 * decimal.One)
+	assert.Equal(t, ob.bids.Len(), 0)
+
+	filledOrder := NewOrder(true, 8 * decimal.One, 1)
+	filledOrder.TimeInForce = FillOrKill
+	matches, err = ob.PlaceLimitOrder(10_100 * decimal.One, filledOrder)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, filledOrder.IsFilled(), true)
+	assert.Equal(t, ob.AskTotalVolume(), 2 * decimal.One)
+}
+
+func TestExpireOrders(t *testing.T) {
+	ob := NewOrderbook()
+
+	gtdOrder := NewOrder(true, 5 * decimal.One, 0)
+	gtdOrder.TimeInForce = GoodTillDate
+	gtdOrder.ExpiresAt = 1_000
+	gtcOrder := NewOrder(true, 5 * decimal.One, 0)
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, gtdOrder)
+	ob.PlaceLimitOrder(10_000 * decimal.One, gtcOrder)
+
+	assert.Equal(t, len(ob.ExpireOrders(999)), 0)
+
+	expired := ob.ExpireOrders(1_000)
+
+	assert.Equal(t, len(expired), 1)
+	assert.Equal(t, expired[0], gtdOrder)
+	assert.Equal(t, ob.BidTotalVolume(), 5 * decimal.One)
+	assert.Equal(t, len(ob.Orders), 1)
+	assert.Equal(t, ob.Orders[gtcOrder.ID], gtcOrder)
+}
+
+func TestPlaceLimitOrderPostOnly(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 10 * decimal.One, 0)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
+
+	crossingOrder := NewOrder(true, 5 * decimal.One, 1)
+	crossingOrder.PostOnly = true
+	matches, err := ob.PlaceLimitOrder(10_000 * decimal.One, crossingOrder)
+
+	assert.Equal(t, err, ErrPostOnlyWouldCross)
+	assert.Equal(t, len(matches), 0)
+	assert.Nil(t, crossingOrder.Limit)
+	assert.Equal(t, ob.AskTotalVolume(), 10 * decimal.One)
+	assert.Equal(t, ob.bids.Len(), 0)
+
+	restingOrder := NewOrder(true, 5 * decimal.One, 1)
+	restingOrder.PostOnly = true
+	_, err = ob.PlaceLimitOrder(9_000 * decimal.One, restingOrder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, restingOrder.Limit.Price, 9_000 * decimal.One)
+}
+
+func TestPlaceLimitOrderPostOnlyReprice(t *testing.T) {
+	ob := NewOrderbook()
+	ob.TickSize = decimal.One
+
+	buyOrder := NewOrder(true, 10 * decimal.One, 0)
+	ob.PlaceLimitOrder(10_000 * decimal.One, buyOrder)
+
+	sellOrder := NewOrder(false, 5 * decimal.One, 1)
+	sellOrder.PostOnly = true
+	sellOrder.PostOnlyReprice = true
+	matches, err := ob.PlaceLimitOrder(9_900 * decimal.One, sellOrder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, sellOrder.Limit.Price, 10_001 * decimal.One)
+	assert.Equal(t, ob.BidTotalVolume(), 10 * decimal.One)
+	assert.Equal(t, ob.AskTotalVolume(), 5 * decimal.One)
+}
+
+func TestStopMarketOrderTriggered(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+	ob.PlaceLimitOrder(10_100 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+
+	stopOrder := NewOrder(true, 3 * decimal.One, 1)
+	ob.PlaceStopOrder(10_000 * decimal.One, decimal.Zero, stopOrder)
+
+	// Pending stops are not part of the visible book
+	assert.Equal(t, ob.BidTotalVolume(), decimal.Zero)
+	_, ok := ob.PendingStop(stopOrder.ID)
+	assert.Equal(t, ok, true)
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 2 * decimal.One, 2))
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, matches[1].Bid, stopOrder)
+	assert.Equal(t, matches[1].SizeFilled, 3 * decimal.One)
+	assert.Equal(t, stopOrder.IsFilled(), true)
+	assert.Equal(t, len(ob.Trades), 2)
+
+	_, ok = ob.PendingStop(stopOrder.ID)
+	assert.Equal(t, ok, false)
+}
+
+func TestStopOrderCascade(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(true, 5 * decimal.One, 0))
+	ob.PlaceLimitOrder(9_900 * decimal.One, NewOrder(true, 5 * decimal.One, 0))
+	ob.PlaceLimitOrder(9_800 * decimal.One, NewOrder(true, 5 * decimal.One, 0))
+
+	// The first stop sells through 9_900 which sets off the second one
+	stopA := NewOrder(false, 6 * decimal.One, 1)
+	stopB := NewOrder(false, 2 * decimal.One, 1)
+	ob.PlaceStopOrder(10_000 * decimal.One, decimal.Zero, stopA)
+	ob.PlaceStopOrder(9_900 * decimal.One, decimal.Zero, stopB)
+
+	// Not triggered yet, nothing traded at or below the stop prices
+	ob.PlaceLimitOrder(10_200 * decimal.One, NewOrder(false, 1 * decimal.One, 2))
+	assert.Equal(t, len(ob.StopOrders), 2)
+
+	matches, err := ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 1 * decimal.One, 2))
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 4)
+	assert.Equal(t, stopA.IsFilled(), true)
+	assert.Equal(t, stopB.IsFilled(), true)
+	assert.Equal(t, len(ob.StopOrders), 0)
+	assert.Equal(t, ob.BidTotalVolume(), 6 * decimal.One)
+	assert.Equal(t, ob.Bids()[0].Price, 9_900 * decimal.One)
+}
+
+func TestStopMarketOrderTriggeredIntoEmptyBook(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 1 * decimal.One, 0))
+
+	stopOrder := NewOrder(true, 3 * decimal.One, 1)
+	ob.PlaceStopOrder(10_000 * decimal.One, decimal.Zero, stopOrder)
+
+	// The trade takes the last ask, the triggered stop has nothing left to match
+	order := NewOrder(true, 1 * decimal.One, 2)
+	matches, err := ob.PlaceMarketOrder(order)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, len(order.ReleasedStops), 1)
+	assert.Equal(t, order.ReleasedStops[0].Order, stopOrder)
+	assert.Equal(t, stopOrder.Size, 3 * decimal.One)
+	assert.Nil(t, stopOrder.Limit)
+	assert.Equal(t, len(ob.StopOrders), 0)
+}
+
+func TestStopLimitOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 2 * decimal.One, 0))
+	ob.PlaceLimitOrder(10_500 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+
+	stopOrder := NewOrder(true, 5 * decimal.One, 1)
+	ob.PlaceStopOrder(10_000 * decimal.One, 10_200 * decimal.One, stopOrder)
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 1 * decimal.One, 2))
+	assert.Nil(t, err)
+
+	// Triggered stop-limit takes the remaining ask at 10_000 and rests at 10_200
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, stopOrder.Size, 4 * decimal.One)
+	assert.Equal(t, stopOrder.Limit.Price, 10_200 * decimal.One)
+	assert.Equal(t, ob.Orders[stopOrder.ID], stopOrder)
+	assert.Equal(t, ob.AskTotalVolume(), 5 * decimal.One)
+}
+
+func TestCancelStopOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+
+	stopOrder := NewOrder(true, 3 * decimal.One, 1)
+	ob.PlaceStopOrder(10_000 * decimal.One, decimal.Zero, stopOrder)
+	ob.CancelStopOrder(stopOrder)
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 1 * decimal.One, 2))
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, stopOrder.Size, 3 * decimal.One)
+	assert.Equal(t, len(ob.StopOrders), 0)
+}
+
+func TestIcebergOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	icebergOrder := NewOrder(false, 25 * decimal.One, 0)
+	icebergOrder.DisplaySize = 10 * decimal.One
+	ob.PlaceLimitOrder(10_000 * decimal.One, icebergOrder)
+
+	assert.Equal(t, icebergOrder.Size, 10 * decimal.One)
+	assert.Equal(t, icebergOrder.HiddenSize, 15 * decimal.One)
+	assert.Equal(t, ob.AskTotalVolume(), 25 * decimal.One)
+	assert.Equal(t, ob.AskDisplayVolume(), 10 * decimal.One)
+
+	// Behind the iceberg slice in the queue
+	sellOrder := NewOrder(false, 5 * decimal.One, 1)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
+
+	// Takes the whole slice, the refreshed slice loses its priority to sellOrder
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 12 * decimal.One, 2))
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, matches[0].Ask, icebergOrder)
+	assert.Equal(t, matches[0].SizeFilled, 10 * decimal.One)
+	assert.Equal(t, matches[1].Ask, sellOrder)
+	assert.Equal(t, matches[1].SizeFilled, 2 * decimal.One)
+
+	assert.Equal(t, icebergOrder.Size, 10 * decimal.One)
+	assert.Equal(t, icebergOrder.HiddenSize, 5 * decimal.One)
+	assert.Equal(t, ob.AskTotalVolume(), 18 * decimal.One)
+	assert.Equal(t, ob.AskDisplayVolume(), 13 * decimal.One)
+	assert.Equal(t, ob.Asks()[0].Orders()[0], sellOrder)
+	assert.Equal(t, ob.Asks()[0].Orders()[1], icebergOrder)
+
+	// Goes through the rest of the level including the whole reserve
+	matches, err = ob.PlaceMarketOrder(NewOrder(true, 18 * decimal.One, 2))
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 3)
+	assert.Equal(t, icebergOrder.IsFilled(), true)
+	assert.Equal(t, ob.AskTotalVolume(), decimal.Zero)
+	assert.Equal(t, ob.asks.Len(), 0)
+	assert.Equal(t, len(ob.Orders), 0)
+}
+
+func TestCancelIcebergOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	icebergOrder := NewOrder(true, 25 * decimal.One, 0)
+	icebergOrder.DisplaySize = 10 * decimal.One
+	ob.PlaceLimitOrder(10_000 * decimal.One, icebergOrder)
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(true, 5 * decimal.One, 1))
+
+	ob.CancelOrder(icebergOrder)
+
+	assert.Equal(t, ob.BidTotalVolume(), 5 * decimal.One)
+	assert.Equal(t, ob.BidDisplayVolume(), 5 * decimal.One)
+	assert.Equal(t, ob.Bids()[0].HiddenVolume, decimal.Zero)
+}
+
+func TestCancelOrders(t *testing.T) {
+	ob := NewOrderbook()
+
+	buyA := NewOrder(true, 5 * decimal.One, 1)
+	buyB := NewOrder(true, 5 * decimal.One, 1)
+	sellA := NewOrder(false, 5 * decimal.One, 1)
+	otherUser := NewOrder(true, 5 * decimal.One, 2)
+	ob.PlaceLimitOrder(9_000 * decimal.One, buyA)
+	ob.PlaceLimitOrder(9_500 * decimal.One, buyB)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellA)
+	ob.PlaceLimitOrder(9_000 * decimal.One, otherUser)
+
+	stopOrder := NewOrder(true, 5 * decimal.One, 1)
+	ob.PlaceStopOrder(11_000 * decimal.One, decimal.Zero, stopOrder)
+
+	cancelled := ob.CancelOrders(func(o *Order) bool {
+		return o.UserID == 1 && o.Bid
+	})
+
+	assert.ElementsMatch(t, cancelled, []*Order{buyA, buyB, stopOrder})
+	assert.Equal(t, ob.bids.Len(), 1)
+	assert.Equal(t, ob.BidTotalVolume(), 5 * decimal.One)
+	assert.Equal(t, ob.AskTotalVolume(), 5 * decimal.One)
+	assert.Equal(t, len(ob.StopOrders), 0)
+	assert.Equal(t, len(ob.Orders), 2)
+}
+
+func TestCancelOrdersIn(t *testing.T) {
+	first, second := NewOrderbook(), NewOrderbook()
+
+	buyA := NewOrder(true, 5 * decimal.One, 1)
+	sellB := NewOrder(false, 5 * decimal.One, 1)
+	otherUser := NewOrder(true, 5 * decimal.One, 2)
+	first.PlaceLimitOrder(9_000 * decimal.One, buyA)
+	first.PlaceLimitOrder(9_000 * decimal.One, otherUser)
+	second.PlaceLimitOrder(100 * decimal.One, sellB)
+
+	cancelled := CancelOrdersIn([]*Orderbook{first, second}, func(o *Order) bool {
+		return o.UserID == 1
+	})
+
+	assert.ElementsMatch(t, cancelled, []*Order{buyA, sellB})
+	assert.Equal(t, len(first.Orders), 1)
+	assert.Equal(t, len(second.Orders), 0)
+	assert.Equal(t, second.asks.Len(), 0)
+
+	// Both books are unlocked again
+	first.PlaceLimitOrder(9_500 * decimal.One, NewOrder(true, decimal.One, 1))
+	second.PlaceLimitOrder(100 * decimal.One, NewOrder(false, decimal.One, 1))
+	assert.Equal(t, len(first.Orders), 2)
+	assert.Equal(t, len(second.Orders), 1)
+}
+
+func TestPlaceRestingOrders(t *testing.T) {
+	first, second := NewOrderbook(), NewOrderbook()
+	first.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 5 * decimal.One, 2))
+
+	bid := NewOrder(true, 5 * decimal.One, 1)
+	ask := NewOrder(false, 5 * decimal.One, 1)
+	// Crosses the bid placed before it in the same batch
+	crossing := NewOrder(true, 5 * decimal.One, 1)
+	i, err := PlaceRestingOrders([]*Orderbook{first, second}, []RestingOrder{
+		{Book: first, Price: 9_000 * decimal.One, Order: bid},
+		{Book: second, Price: 100 * decimal.One, Order: ask},
+		{Book: second, Price: 100 * decimal.One, Order: crossing},
+	})
+	assert.ErrorIs(t, err, ErrOrderWouldCross)
+	assert.Equal(t, i, 2)
+	assert.Equal(t, len(first.Orders), 1)
+	assert.Equal(t, len(second.Orders), 0)
+	assert.Equal(t, first.bids.Len(), 0)
+	assert.Equal(t, second.asks.Len(), 0)
+
+	_, err = PlaceRestingOrders([]*Orderbook{first, second}, []RestingOrder{
+		{Book: first, Price: 9_000 * decimal.One, Order: bid},
+		{Book: second, Price: 100 * decimal.One, Order: ask},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, first.BestBid().Price, 9_000 * decimal.One)
+	assert.Equal(t, second.BestAsk().Price, 100 * decimal.One)
+	assert.Equal(t, len(first.Trades) + len(second.Trades), 0)
+}
+
+func TestAmendOrderSizeDecreaseKeepsPriority(t *testing.T) {
+	ob := NewOrderbook()
+
+	first := NewOrder(false, 10 * decimal.One, 1)
+	second := NewOrder(false, 10 * decimal.One, 2)
+	ob.PlaceLimitOrder(10_000 * decimal.One, first)
+	ob.PlaceLimitOrder(10_000 * decimal.One, second)
+
+	matches, err := ob.AmendOrder(first, 10_000 * decimal.One, 4 * decimal.One, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 0)
+
+	assert.Equal(t, first.Size, 4 * decimal.One)
+	assert.Equal(t, ob.AskTotalVolume(), 14 * decimal.One)
+	assert.Equal(t, ob.Asks()[0].Orders()[0], first)
+}
+
+func TestAmendOrderLosesPriority(t *testing.T) {
+	ob := NewOrderbook()
+
+	first := NewOrder(false, 10 * decimal.One, 1)
+	second := NewOrder(false, 10 * decimal.One, 2)
+	ob.PlaceLimitOrder(10_000 * decimal.One, first)
+	ob.PlaceLimitOrder(10_000 * decimal.One, second)
+
+	// Size increase, back of the queue of the same price
+	_, err := ob.AmendOrder(first, 10_000 * decimal.One, 12 * decimal.One, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ob.Asks()[0].Orders()[0], second)
+	assert.Equal(t, ob.Asks()[0].Orders()[1], first)
+	assert.Equal(t, ob.AskTotalVolume(), 22 * decimal.One)
+
+	// Price change, the old level is cleared once empty
+	_, err = ob.AmendOrder(second, 9_000 * decimal.One, 10 * decimal.One, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ob.asks.Len(), 2)
+	assert.Equal(t, ob.BestAsk().Price, 9_000 * decimal.One)
+	assert.Equal(t, ob.Asks()[1].Orders()[0], first)
+}
+
+func TestAmendOrderCrossing(t *testing.T) {
+	ob := NewOrderbook()
+
+	buyOrder := NewOrder(true, 5 * decimal.One, 1)
+	ob.PlaceLimitOrder(9_000 * decimal.One, buyOrder)
+
+	sellOrder := NewOrder(false, 8 * decimal.One, 2)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
+
+	matches, err := ob.AmendOrder(sellOrder, 9_000 * decimal.One, 8 * decimal.One, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].SizeFilled, 5 * decimal.One)
+	assert.Equal(t, ob.bids.Len(), 0)
+	assert.Equal(t, ob.BestAsk().Price, 9_000 * decimal.One)
+	assert.Equal(t, sellOrder.Size, 3 * decimal.One)
+}
+
+func TestAmendOrderPostOnlyWouldCross(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(9_000 * decimal.One, NewOrder(true, 5 * decimal.One, 1))
+
+	sellOrder := NewOrder(false, 8 * decimal.One, 2)
+	sellOrder.PostOnly = true
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
+
+	_, err := ob.AmendOrder(sellOrder, 9_000 * decimal.One, 8 * decimal.One, nil)
+	assert.ErrorIs(t, err, ErrPostOnlyWouldCross)
+	assert.Equal(t, sellOrder.Limit.Price, 10_000 * decimal.One)
+	assert.Equal(t, ob.AskTotalVolume(), 8 * decimal.One)
+}
+
+func TestAmendIcebergOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	icebergOrder := NewOrder(false, 25 * decimal.One, 0)
+	icebergOrder.DisplaySize = 10 * decimal.One
+	ob.PlaceLimitOrder(10_000 * decimal.One, icebergOrder)
+
+	// The reserve goes first
+	_, err := ob.AmendOrder(icebergOrder, 10_000 * decimal.One, 12 * decimal.One, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, icebergOrder.Size, 10 * decimal.One)
+	assert.Equal(t, icebergOrder.HiddenSize, 2 * decimal.One)
+	assert.Equal(t, ob.AskDisplayVolume(), 10 * decimal.One)
+
+	_, err = ob.AmendOrder(icebergOrder, 10_000 * decimal.One, 6 * decimal.One, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, icebergOrder.Size, 6 * decimal.One)
+	assert.Equal(t, icebergOrder.HiddenSize, decimal.Zero)
+	assert.Equal(t, ob.AskTotalVolume(), 6 * decimal.One)
+	assert.Equal(t, ob.AskDisplayVolume(), 6 * decimal.One)
+}
+
+func TestAmendOrderKeepsPriceAndSize(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 10 * decimal.One, 1)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
+	ob.PlaceMarketOrder(NewOrder(true, 4 * decimal.One, 2))
+
+	// The size kept is what is left after the fill
+	var price, size decimal.Decimal
+	check := func(p, s decimal.Decimal) error {
+		price, size = p, s
+		return nil
+	}
+	_, err := ob.AmendOrder(sellOrder, 11_000 * decimal.One, 0, check)
+	assert.Nil(t, err)
+	assert.Equal(t, price, 11_000 * decimal.One)
+	assert.Equal(t, size, 6 * decimal.One)
+	assert.Equal(t, sellOrder.Size, 6 * decimal.One)
+
+	_, err = ob.AmendOrder(sellOrder, 0, 2 * decimal.One, check)
+	assert.Nil(t, err)
+	assert.Equal(t, price, 11_000 * decimal.One)
+	assert.Equal(t, ob.BestAsk().Price, 11_000 * decimal.One)
+	assert.Equal(t, sellOrder.Size, 2 * decimal.One)
+
+	// A rejected check leaves the order as it was
+	errRejected := errors.New("rejected")
+	_, err = ob.AmendOrder(sellOrder, 9_000 * decimal.One, 0, func(p, s decimal.Decimal) error {
+		return errRejected
+	})
+	assert.ErrorIs(t, err, errRejected)
+	assert.Equal(t, ob.BestAsk().Price, 11_000 * decimal.One)
+	assert.Equal(t, sellOrder.Size, 2 * decimal.One)
+}
+
+func TestAmendOrderNotResting(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 5 * decimal.One, 1)
+	ob.PlaceLimitOrder(10_000 * decimal.One, sellOrder)
+	ob.PlaceMarketOrder(NewOrder(true, 5 * decimal.One, 2))
+
+	_, err := ob.AmendOrder(sellOrder, 10_000 * decimal.One, 5 * decimal.One, nil)
+	assert.ErrorIs(t, err, ErrOrderNotResting)
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	tests := []struct {
+		mode 						SelfTradePrevention
+		takerSize 			decimal.Decimal
+		makerCancelled 	bool
+		takerCancelled 	bool
+		// Size left on the resting self order and on the taker
+		makerSize 			decimal.Decimal
+		takerLeft 			decimal.Decimal
+		// Size traded with the order of the other user
+		traded 					decimal.Decimal
+	}{
+		{CancelNewest, 8 * decimal.One, false, true, 5 * decimal.One, 8 * decimal.One, decimal.Zero},
+		{CancelOldest, 8 * decimal.One, true, false, 5 * decimal.One, decimal.Zero, 8 * decimal.One},
+		{CancelBoth, 8 * decimal.One, true, true, 5 * decimal.One, 8 * decimal.One, decimal.Zero},
+		{DecrementAndCancel, 8 * decimal.One, true, false, 5 * decimal.One, decimal.Zero, 3 * decimal.One},
+		{DecrementAndCancel, 3 * decimal.One, false, true, 2 * decimal.One, 3 * decimal.One, decimal.Zero},
+		{DecrementAndCancel, 5 * decimal.One, true, true, 5 * decimal.One, 5 * decimal.One, decimal.Zero},
+	}
+
+	for _, tc := range tests {
+		ob := NewOrderbook()
+
+		selfOrder := NewOrder(false, 5 * decimal.One, 1)
+		otherOrder := NewOrder(false, 10 * decimal.One, 2)
+		ob.PlaceLimitOrder(10_000 * decimal.One, selfOrder)
+		ob.PlaceLimitOrder(10_000 * decimal.One, otherOrder)
+
+		taker := NewOrder(true, tc.takerSize, 1)
+		taker.SelfTradePrevention = tc.mode
+		taker.TimeInForce = ImmediateOrCancel
+		matches, err := ob.PlaceLimitOrder(10_000 * decimal.One, taker)
+		assert.Nil(t, err, tc.mode)
+
+		traded := decimal.Zero
+		for _, match := range matches {
+			assert.Equal(t, match.Ask, otherOrder, tc.mode)
+			traded += match.SizeFilled
+		}
+		assert.Equal(t, traded, tc.traded, tc.mode)
+
+		assert.Equal(t, len(taker.PreventedMatches), 1, tc.mode)
+		pm := taker.PreventedMatches[0]
+		assert.Equal(t, pm.Maker, selfOrder, tc.mode)
+		assert.Equal(t, pm.MakerCancelled, tc.makerCancelled, tc.mode)
+		assert.Equal(t, pm.TakerCancelled, tc.takerCancelled, tc.mode)
+		assert.Equal(t, selfOrder.Size, tc.makerSize, tc.mode)
+		assert.Equal(t, taker.Size, tc.takerLeft, tc.mode)
+
+		_, resting := ob.Orders[selfOrder.ID]
+		assert.Equal(t, resting, !tc.makerCancelled, tc.mode)
+		assert.Equal(t, selfOrder.Limit == nil, tc.makerCancelled, tc.mode)
+	}
+}
+
+func TestSelfTradePreventionFillOrKill(t *testing.T) {
+	tests := []struct {
+		mode 			SelfTradePrevention
+		size 			decimal.Decimal
+		// Whether the FOK order fills, it is killed otherwise
+		fills 		bool
+	}{
+		// The resting order of the user doesn't count as liquidity
+		{CancelOldest, 3 * decimal.One, true},
+		{CancelOldest, 4 * decimal.One, false},
+		// The order of the user cuts the taker short after the first ask
+		{CancelNewest, 1 * decimal.One, true},
+		{CancelNewest, 2 * decimal.One, false},
+		{CancelBoth, 2 * decimal.One, false},
+		{DecrementAndCancel, 2 * decimal.One, false},
+	}
+
+	for _, tc := range tests {
+		ob := NewOrderbook()
+
+		ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 1 * decimal.One, 2))
+		selfOrder := NewOrder(false, 1 * decimal.One, 1)
+		ob.PlaceLimitOrder(10_000 * decimal.One, selfOrder)
+		ob.PlaceLimitOrder(10_100 * decimal.One, NewOrder(false, 2 * decimal.One, 2))
+
+		taker := NewOrder(true, tc.size, 1)
+		taker.SelfTradePrevention = tc.mode
+		taker.TimeInForce = FillOrKill
+		matches, err := ob.PlaceLimitOrder(10_100 * decimal.One, taker)
+		assert.Nil(t, err, tc.mode)
+
+		filled := decimal.Zero
+		for _, match := range matches {
+			filled += match.SizeFilled
+		}
+		if tc.fills {
+			assert.Equal(t, filled, tc.size, tc.mode)
+		} else {
+			assert.Equal(t, filled, decimal.Zero, tc.mode)
+			assert.Equal(t, selfOrder.Limit != nil, true, tc.mode)
+		}
+	}
+
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 1 * decimal.One, 1))
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 1 * decimal.One, 2))
+
+	// Same for the liquidity check of a market order
+	taker := NewOrder(true, 2 * decimal.One, 1)
+	taker.SelfTradePrevention = CancelOldest
+	_, err := ob.PlaceMarketOrder(taker)
+	assert.ErrorIs(t, err, ErrInsufficientLiquidity)
+}
+
+func TestSelfTradeAllowedByDefault(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 5 * decimal.One, 1))
+
+	taker := NewOrder(true, 5 * decimal.One, 1)
+	matches, err := ob.PlaceMarketOrder(taker)
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, len(taker.PreventedMatches), 0)
+}
+
+func TestPlaceMarketOrderEmptyBook(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(true, 10 * decimal.One, 0))
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 1 * decimal.One, 1))
+
+	assert.ErrorIs(t, err, ErrEmptyBook)
+	assert.Equal(t, len(matches), 0)
+}
+
+func TestPlaceMarketOrderInsufficientLiquidity(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 10 * decimal.One, 0))
+
+	buyOrder := NewOrder(true, 15 * decimal.One, 1)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	assert.ErrorIs(t, err, ErrInsufficientLiquidity)
+	assert.Equal(t, len(matches), 0)
+	assert.Equal(t, buyOrder.Size, 15 * decimal.One)
+	assert.Equal(t, ob.AskTotalVolume(), 10 * decimal.One)
+}
+
+func TestPlaceMarketOrderIOC(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 10 * decimal.One, 0))
+
+	buyOrder := NewOrder(true, 15 * decimal.One, 1)
+	buyOrder.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].SizeFilled, 10 * decimal.One)
+	assert.Equal(t, buyOrder.Size, 5 * decimal.One)
+	assert.Equal(t, ob.asks.Len(), 0)
+}
+
+func TestPlaceMarketOrderBudget(t *testing.T) {
+	ob := NewOrderbook()
+	ob.LotSize = decimal.One / 10
+
+	ob.PlaceLimitOrder(100 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+	ob.PlaceLimitOrder(200 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+
+	// 500 buys the first level, the remaining 150 buys 0.75 rounded down to 0.7
+	buyOrder := NewOrder(true, 10 * decimal.One, 1)
+	buyOrder.Budget = 650 * decimal.One
+	_, err := ob.PlaceMarketOrder(buyOrder)
+	assert.ErrorIs(t, err, ErrInsufficientBudget)
+	assert.Equal(t, ob.AskTotalVolume(), 10 * decimal.One)
+
+	buyOrder.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert.Nil(t, err)
+
+	spent := decimal.Zero
+	for _, match := range matches {
+		spent += match.SizeFilled.Mul(match.Price)
+	}
+	assert.Equal(t, spent, 640 * decimal.One)
+	assert.Equal(t, buyOrder.Size, decimal.MustParse("4.3"))
+	assert.Equal(t, ob.AskTotalVolume(), decimal.MustParse("4.3"))
+}
+
+func TestStopMarketOrderBudget(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(100 * decimal.One, NewOrder(false, 1 * decimal.One, 0))
+	ob.PlaceLimitOrder(5_000 * decimal.One, NewOrder(false, 10 * decimal.One, 0))
+
+	// Funded at its stop price, the stop can't take the asks at 5_000
+	stopOrder := NewOrder(true, 10 * decimal.One, 1)
+	stopOrder.Budget = 1_000 * decimal.One
+	ob.PlaceStopOrder(100 * decimal.One, decimal.Zero, stopOrder)
+
+	order := NewOrder(true, 1 * decimal.One, 2)
+	matches, err := ob.PlaceMarketOrder(order)
+	assert.Nil(t, err)
+
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, matches[1].Bid, stopOrder)
+	assert.Equal(t, matches[1].SizeFilled, decimal.One / 5)
+	assert.Equal(t, stopOrder.Size, decimal.MustParse("9.8"))
+	assert.Equal(t, order.ReleasedStops[0].Order, stopOrder)
+}
+
+func TestPlaceMarketOrderWorstPrice(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+	ob.PlaceLimitOrder(10_100 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+	ob.PlaceLimitOrder(10_500 * decimal.One, NewOrder(false, 5 * decimal.One, 0))
+
+	buyOrder := NewOrder(true, 12 * decimal.One, 1)
+	buyOrder.WorstPrice = 10_100 * decimal.One
+	_, err := ob.PlaceMarketOrder(buyOrder)
+
+	// Not enough volume within the collar to fill the whole order
+	assert.ErrorIs(t, err, ErrInsufficientLiquidity)
+	assert.Equal(t, ob.AskTotalVolume(), 15 * decimal.One)
+
+	buyOrder.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, buyOrder.Size, 2 * decimal.One)
+	assert.Equal(t, ob.Asks()[0].Price, 10_500 * decimal.One)
+}
+
+func TestPlaceMarketOrderMaxSlippage(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(true, 5 * decimal.One, 0))
+	ob.PlaceLimitOrder(9_950 * decimal.One, NewOrder(true, 5 * decimal.One, 0))
+	ob.PlaceLimitOrder(9_900 * decimal.One, NewOrder(true, 5 * decimal.One, 0))
+
+	// 50 bps below the best bid of 10_000
+	sellOrder := NewOrder(false, 15 * decimal.One, 1)
+	sellOrder.MaxSlippageBps = 50
+	sellOrder.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, matches[1].Price, 9_950 * decimal.One)
+	assert.Equal(t, sellOrder.Size, 5 * decimal.One)
+	assert.Equal(t, ob.BidTotalVolume(), 5 * decimal.One)
+}
+
+func TestFractionalSizesFillExactly(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(decimal.MustParse("1000.01"), NewOrder(false, decimal.MustParse("0.1"), 0))
+	ob.PlaceLimitOrder(decimal.MustParse("1000.02"), NewOrder(false, decimal.MustParse("0.2"), 0))
+
+	buyOrder := NewOrder(true, decimal.MustParse("0.3"), 1)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(matches), 2)
+	assert.Equal(t, buyOrder.IsFilled(), true)
+	assert.Equal(t, ob.AskTotalVolume(), decimal.Zero)
+	assert.Equal(t, ob.asks.Len(), 0)
+}
+
+func TestEstimateCost(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000 * decimal.One, NewOrder(false, 2 * decimal.One, 0))
+	ob.PlaceLimitOrder(10_100 * decimal.One, NewOrder(false, 2 * decimal.One, 0))
+	ob.PlaceLimitOrder(9_900 * decimal.One, NewOrder(true, 1 * decimal.One, 0))
+
+	assert.Equal(t, ob.EstimateCost(true, 3 * decimal.One), 30_100 * decimal.One)
+	// Only what the book can fill counts
+	assert.Equal(t, ob.EstimateCost(true, 10 * decimal.One), 40_200 * decimal.One)
+	assert.Equal(t, ob.EstimateCost(false, decimal.MustParse("0.5")), 4_950 * decimal.One)
+	// The book is left untouched
+	assert.Equal(t, ob.AskTotalVolume(), 4 * decimal.One)
+}
+
+func TestLevelsOrdering(t *testing.T) {
+	ob := NewOrderbook()
+
+	prices := rand.Perm(200)
+	for _, price := range prices {
+		ob.PlaceLimitOrder(decimal.FromInt(int64(1_000+price)), NewOrder(false, decimal.One, 0))
+		ob.PlaceLimitOrder(decimal.FromInt(int64(500-price)), NewOrder(true, decimal.One, 0))
+	}
+
+	asks := ob.Asks()
+	bids := ob.Bids()
+	assert.Equal(t, len(asks), 200)
+	assert.Equal(t, len(bids), 200)
+	for i := 1; i < len(asks); i++ {
+		assert.Less(t, asks[i-1].Price, asks[i].Price)
+		assert.Greater(t, bids[i-1].Price, bids[i].Price)
+	}
+	assert.Equal(t, ob.BestAsk().Price, 1_000*decimal.One)
+	assert.Equal(t, ob.BestBid().Price, 500*decimal.One)
+
+	// Cancel every other level, the rest keeps its order
+	for _, limit := range asks {
+		if limit.Price%(2*decimal.One) == 0 {
+			ob.CancelOrder(limit.Orders()[0])
+		}
+	}
+
+	asks = ob.Asks()
+	assert.Equal(t, len(asks), 100)
+	assert.Equal(t, ob.asks.Len(), 100)
+	for i := 1; i < len(asks); i++ {
+		assert.Less(t, asks[i-1].Price, asks[i].Price)
+	}
+	assert.Equal(t, ob.BestAsk().Price, 1_001*decimal.One)
+}
+
+// sortedSliceBook mirrors the former storage of the levels, a slice sorted
+// on every read and scanned linearly on removal, as a baseline for the benchmarks
+type sortedSliceBook struct {
+	asks []*Limit
+}
+
+func (b *sortedSliceBook) insert(limit *Limit) {
+	b.asks = append(b.asks, limit)
+}
+
+func (b *sortedSliceBook) remove(limit *Limit) {
+	for i := 0; i < len(b.asks); i++ {
+		if b.asks[i] == limit {
+			b.asks[i] = b.asks[len(b.asks)-1]
+			b.asks = b.asks[:len(b.asks)-1]
+		}
+	}
+}
+
+func (b *sortedSliceBook) best() *Limit {
+	sort.Slice(b.asks, func(i, j int) bool { return b.asks[i].Price < b.asks[j].Price })
+	return b.asks[0]
+}
+
+const benchmarkLevels = 1_000
+
+func BenchmarkBestAskSortedSlice(b *testing.B) {
+	book := &sortedSliceBook{}
+	for _, price := range rand.Perm(benchmarkLevels) {
+		book.insert(NewLimit(decimal.FromInt(int64(1_000 + price))))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		book.best()
+	}
+}
+
+func BenchmarkBestAskLevels(b *testing.B) {
+	ob := NewOrderbook()
+	for _, price := range rand.Perm(benchmarkLevels) {
+		ob.asks.Insert(NewLimit(decimal.FromInt(int64(1_000 + price))))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob.BestAsk()
+	}
+}
+
+func BenchmarkInsertCancelSortedSlice(b *testing.B) {
+	book := &sortedSliceBook{}
+	for _, price := range rand.Perm(benchmarkLevels) {
+		book.insert(NewLimit(decimal.FromInt(int64(1_000 + price))))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		limit := NewLimit(decimal.FromInt(int64(1_000 + i%benchmarkLevels)) + decimal.One/2)
+		book.insert(limit)
+		book.best()
+		book.remove(limit)
+	}
+}
+
+func BenchmarkInsertCancelLevels(b *testing.B) {
+	ob := NewOrderbook()
+	for _, price := range rand.Perm(benchmarkLevels) {
+		ob.asks.Insert(NewLimit(decimal.FromInt(int64(1_000 + price))))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		limit := NewLimit(decimal.FromInt(int64(1_000 + i%benchmarkLevels)) + decimal.One/2)
+		ob.asks.Insert(limit)
+		ob.BestAsk()
+		ob.asks.Remove(limit.Price)
+	}
+}
+
+func BenchmarkCancelOrderInLevel(b *testing.B) {
+	limit := NewLimit(10_000 * decimal.One)
+	for i := 0; i < benchmarkLevels; i++ {
+		limit.AddOrder(NewOrder(false, decimal.One, 0))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		order := NewOrder(false, decimal.One, 0)
+		limit.AddOrder(order)
+		limit.DeleteOrder(order)
+	}
+}
+
+func TestIDGeneratorPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids", "orders")
+
+	ids, err := NewIDGenerator(path)
+	assert.Nil(t, err)
+
+	first, err := ids.Next()
+	assert.Nil(t, err)
+	second, err := ids.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, first, int64(1))
+	assert.Equal(t, second, int64(2))
+
+	// A restarted sequence never hands out an ID again
+	restarted, err := NewIDGenerator(path)
+	assert.Nil(t, err)
+	next, err := restarted.Next()
+	assert.Nil(t, err)
+	assert.Greater(t, next, second)
+}
+
+func TestIDGeneratorConcurrent(t *testing.T) {
+	ids, err := NewIDGenerator(filepath.Join(t.TempDir(), "trades"))
+	assert.Nil(t, err)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				id := ids.MustNext()
+				mu.Lock()
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, len(seen), 4_000)
+}
+
+func TestTradeAttribution(t *testing.T) {
+	ob := NewOrderbook()
+	ob.Market = "ETH"
+
+	sellOrder := NewOrder(false, 10*decimal.One, 7)
+	ob.PlaceLimitOrder(10_000*decimal.One, sellOrder)
+
+	buyOrder := NewOrder(true, 4*decimal.One, 3)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert.Nil(t, err)
+
+	secondBuy := NewOrder(true, 4*decimal.One, 3)
+	_, err = ob.PlaceMarketOrder(secondBuy)
+	assert.Nil(t, err)
+
+	trade := ob.Trades[0]
+	assert.Equal(t, trade.ID, matches[0].TradeID)
+	assert.Equal(t, trade.MakerOrderID, sellOrder.ID)
+	assert.Equal(t, trade.TakerOrderID, buyOrder.ID)
+	assert.Equal(t, trade.MakerUserID, int64(7))
+	assert.Equal(t, trade.TakerUserID, int64(3))
+	assert.Equal(t, trade.AggressorSide, "BID")
+	assert.Equal(t, trade.Market, "ETH")
+	assert.Greater(t, ob.Trades[1].ID, trade.ID)
+	assert.Greater(t, secondBuy.ID, buyOrder.ID)
+}
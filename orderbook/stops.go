@@ -0,0 +1,198 @@
+package orderbook
+
+import (
+	"sort"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+// Stop order waiting in the trigger book until a trade prints at or
+// through its stop price: above for a buy stop, below for a sell stop.
+// Once triggered it is released as a market order, or as a limit order
+// at LimitPrice for a stop-limit.
+type StopOrder struct {
+	Order      *Order
+	StopPrice  decimal.Decimal
+	LimitPrice decimal.Decimal // 0 for a stop-market order
+}
+
+func (s *StopOrder) IsStopLimit() bool {
+	return s.LimitPrice != 0
+}
+
+func (s *StopOrder) isTriggeredBy(price decimal.Decimal) bool {
+	if s.Order.Bid {
+		return price >= s.StopPrice
+	}
+	return price <= s.StopPrice
+}
+
+func (ob *Orderbook) PlaceStopOrder(stopPrice, limitPrice decimal.Decimal, o *Order) *StopOrder {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	stop := &StopOrder{
+		Order:      o,
+		StopPrice:  stopPrice,
+		LimitPrice: limitPrice,
+	}
+
+	if o.Bid {
+		ob.buyStops[stopPrice] = append(ob.buyStops[stopPrice], stop)
+	} else {
+		ob.sellStops[stopPrice] = append(ob.sellStops[stopPrice], stop)
+	}
+	ob.StopOrders[o.ID] = stop
+
+	logrus.WithFields(logrus.Fields{
+		"stopPrice":  stopPrice,
+		"limitPrice": limitPrice,
+		"type":       o.Type(),
+		"size":       o.Size,
+		"userID":     o.UserID,
+	}).Info("New stop order")
+
+	return stop
+}
+
+func (ob *Orderbook) CancelStopOrder(o *Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	stop, ok := ob.StopOrders[o.ID]
+	if !ok {
+		return
+	}
+
+	ob.removeStop(stop)
+}
+
+// PendingStop returns the stop order with the given order ID if it didn't trigger yet
+func (ob *Orderbook) PendingStop(id int64) (*StopOrder, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	stop, ok := ob.StopOrders[id]
+	return stop, ok
+}
+
+func (ob *Orderbook) removeStop(stop *StopOrder) {
+	stops := ob.sellStops
+	if stop.Order.Bid {
+		stops = ob.buyStops
+	}
+
+	level := stops[stop.StopPrice]
+	for i := 0; i < len(level); i++ {
+		if level[i] == stop {
+			level = append(level[:i], level[i+1:]...)
+			break
+		}
+	}
+
+	if len(level) == 0 {
+		delete(stops, stop.StopPrice)
+	} else {
+		stops[stop.StopPrice] = level
+	}
+
+	delete(ob.StopOrders, stop.Order.ID)
+}
+
+// releaseStops triggers the stop orders set off by the trades of o printed
+// from index fromTrade onwards and adds them to the released stops of o.
+// Released stops can print new trades which in turn trigger other stops,
+// so this goes on until no more stop is triggered.
+func (ob *Orderbook) releaseStops(o *Order, fromTrade int) []Match {
+	matches := []Match{}
+
+	for fromTrade < len(ob.Trades) {
+		trades := ob.Trades[fromTrade:]
+		fromTrade = len(ob.Trades)
+
+		for _, stop := range ob.triggeredStops(trades) {
+			matches = append(matches, ob.releaseStop(stop)...)
+			o.ReleasedStops = append(o.ReleasedStops, stop)
+		}
+	}
+
+	return matches
+}
+
+// triggeredStops removes the stops triggered by the trades from the trigger
+// book and returns them, closest to the market first
+func (ob *Orderbook) triggeredStops(trades []*Trade) []*StopOrder {
+	triggered := []*StopOrder{}
+	if len(trades) == 0 {
+		return triggered
+	}
+
+	low, high := trades[0].Price, trades[0].Price
+	for _, trade := range trades {
+		if trade.Price < low {
+			low = trade.Price
+		}
+		if trade.Price > high {
+			high = trade.Price
+		}
+	}
+
+	triggered = append(triggered, collectTriggered(ob.buyStops, high)...)
+	triggered = append(triggered, collectTriggered(ob.sellStops, low)...)
+
+	for _, stop := range triggered {
+		ob.removeStop(stop)
+	}
+
+	return triggered
+}
+
+// collectTriggered returns the stops triggered at price, sorted by stop price
+// closest to the market first and by time priority within a stop price
+func collectTriggered(book map[decimal.Decimal][]*StopOrder, price decimal.Decimal) []*StopOrder {
+	triggered := []*StopOrder{}
+
+	for _, stops := range book {
+		for _, stop := range stops {
+			if stop.isTriggeredBy(price) {
+				triggered = append(triggered, stop)
+			}
+		}
+	}
+
+	sort.SliceStable(triggered, func(i, j int) bool {
+		a, b := triggered[i], triggered[j]
+		if a.StopPrice != b.StopPrice {
+			if a.Order.Bid {
+				return a.StopPrice < b.StopPrice
+			}
+			return a.StopPrice > b.StopPrice
+		}
+		return a.Order.Timestamp < b.Order.Timestamp
+	})
+
+	return triggered
+}
+
+// releaseStop sends a triggered stop to the book, a stop-market fills what
+// is available within its collar and budget and the rest is cancelled
+func (ob *Orderbook) releaseStop(stop *StopOrder) []Match {
+	logrus.WithFields(logrus.Fields{
+		"stopPrice":  stop.StopPrice,
+		"limitPrice": stop.LimitPrice,
+		"type":       stop.Order.Type(),
+		"size":       stop.Order.Size,
+		"userID":     stop.Order.UserID,
+	}).Info("Stop order triggered")
+
+	if stop.IsStopLimit() {
+		matches, err := ob.placeLimitOrder(stop.LimitPrice, stop.Order)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to release stop-limit order")
+		}
+		return matches
+	}
+
+	return ob.match(stop.Order, ob.withinCollar(stop.Order))
+}
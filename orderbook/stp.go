@@ -0,0 +1,98 @@
+package orderbook
+
+import (
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+// What happens when a taker order would match a resting order of the same
+// user, the mode of the taker applies. Empty means self trades are allowed.
+type SelfTradePrevention string
+
+const (
+	// The taker is cancelled, the resting order stays in the book
+	CancelNewest SelfTradePrevention = "CANCEL_NEWEST"
+	// The resting order is cancelled and the taker goes on matching
+	CancelOldest SelfTradePrevention = "CANCEL_OLDEST"
+	CancelBoth   SelfTradePrevention = "CANCEL_BOTH"
+	// The larger order is decremented by the size of the smaller one,
+	// which is cancelled. Both are cancelled when they have the same size.
+	DecrementAndCancel SelfTradePrevention = "DECREMENT_AND_CANCEL"
+)
+
+func (m SelfTradePrevention) IsValid() bool {
+	switch m {
+	case "", CancelNewest, CancelOldest, CancelBoth, DecrementAndCancel:
+		return true
+	}
+	return false
+}
+
+// A match between two orders of the same user which was prevented
+type PreventedMatch struct {
+	Maker 					*Order
+	Taker 					*Order
+	Mode 						SelfTradePrevention
+	Price 					decimal.Decimal
+	// Size which would have traded
+	Size 						decimal.Decimal
+	MakerCancelled 	bool
+	TakerCancelled 	bool
+}
+
+func (o *Order) isSelfTrade(maker *Order) bool {
+	return o.SelfTradePrevention != "" && o.UserID == maker.UserID
+}
+
+// preventSelfTrade applies the self-trade prevention of the taker to a
+// resting order of the same user instead of matching them
+func (l *Limit) preventSelfTrade(maker, taker *Order) PreventedMatch {
+	pm := PreventedMatch{
+		Maker: 	maker,
+		Taker: 	taker,
+		Mode: 	taker.SelfTradePrevention,
+		Price: 	l.Price,
+		Size: 	taker.Size,
+	}
+	if maker.TotalSize() < pm.Size {
+		pm.Size = maker.TotalSize()
+	}
+
+	switch taker.SelfTradePrevention {
+	case CancelNewest:
+		pm.TakerCancelled = true
+	case CancelOldest:
+		pm.MakerCancelled = true
+	case CancelBoth:
+		pm.MakerCancelled, pm.TakerCancelled = true, true
+	case DecrementAndCancel:
+		makerSize := maker.TotalSize()
+		switch {
+		case makerSize == taker.Size:
+			pm.MakerCancelled, pm.TakerCancelled = true, true
+		case makerSize < taker.Size:
+			taker.Size -= makerSize
+			pm.MakerCancelled = true
+		default:
+			l.reduceOrder(maker, taker.Size)
+			pm.TakerCancelled = true
+		}
+	}
+
+	if pm.MakerCancelled {
+		l.DeleteOrder(maker)
+	}
+	if pm.TakerCancelled {
+		taker.selfTradeCancelled = true
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID": 	taker.UserID,
+		"maker": 		maker.ID,
+		"taker": 		taker.ID,
+		"mode": 		pm.Mode,
+		"size": 		pm.Size,
+	}).Info("Prevented self trade")
+
+	return pm
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func amendTestOrder(t *testing.T, ex *Exchange, id int64, price, size string) *httptest.ResponseRecorder {
+	body, err := json.Marshal(AmendOrderRequest{Price: decimal.MustParse(price), Size: decimal.MustParse(size)})
+	assert.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/order/"+strconv.FormatInt(id, 10), strings.NewReader(string(body)))
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(strconv.FormatInt(id, 10))
+	assert.Nil(t, ex.handleAmendOrder(c))
+
+	return rec
+}
+
+func TestHandleAmendOrderKeepsRemainingSize(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	ask := placeTestOrder(t, ex, limitOrder(1, false, "3", "1000"))
+	placeTestOrder(t, ex, limitOrder(8, true, "1", "1000"))
+
+	// Only the price changes, the size kept is what is left after the fill
+	rec := amendTestOrder(t, ex, ask.OrderID, "1010", "0")
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	record, _ := ex.records.get(ask.OrderID)
+	assert.Equal(t, record.Price, 1010 * decimal.One)
+	assert.Equal(t, record.RemainingSize, 2 * decimal.One)
+	assert.Equal(t, record.FilledSize, decimal.One)
+	assert.Equal(t, balanceOf(ex.ledger, 1, "ETH").Locked, 2 * decimal.One)
+
+	// Only the size changes
+	rec = amendTestOrder(t, ex, ask.OrderID, "0", "5")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	record, _ = ex.records.get(ask.OrderID)
+	assert.Equal(t, record.Price, 1010 * decimal.One)
+	assert.Equal(t, record.RemainingSize, 5 * decimal.One)
+	assert.Equal(t, balanceOf(ex.ledger, 1, "ETH").Locked, 5 * decimal.One)
+	assert.Nil(t, ex.ledger.verify())
+}
+
+func TestHandleAmendOrderResizesHold(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	bid := placeTestOrder(t, ex, limitOrder(8, true, "2", "990"))
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 1980 * decimal.One)
+
+	rec := amendTestOrder(t, ex, bid.OrderID, "995", "4")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 3980 * decimal.One)
+
+	// Not enough funds, the hold is left as it was
+	rec = amendTestOrder(t, ex, bid.OrderID, "20000", "999")
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	var apiErr APIError
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &apiErr))
+	assert.Equal(t, apiErr.Code, ErrCodeInsufficientFunds)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 3980 * decimal.One)
+
+	record, _ := ex.records.get(bid.OrderID)
+	assert.Equal(t, record.RemainingSize, 4 * decimal.One)
+	assert.Nil(t, ex.ledger.verify())
+}
+
+func TestHandleAmendOrderCrossingTrimsHold(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1005"))
+	bid := placeTestOrder(t, ex, limitOrder(8, true, "3", "990"))
+
+	// Fills 1 at 1005 out of the 3 * 1030 held, the rest stays held at 1030
+	rec := amendTestOrder(t, ex, bid.OrderID, "1030", "0")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 2060 * decimal.One)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Available, 10_000_000 * decimal.One - 3065 * decimal.One)
+	assert.Nil(t, ex.ledger.verify())
+}
+
+func TestHandleAmendOrderRejected(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	p := limitOrder(8, true, "2", "990")
+	p.PostOnly = true
+	bid := placeTestOrder(t, ex, p)
+
+	// Would cross, the order and its hold are left as they were
+	rec := amendTestOrder(t, ex, bid.OrderID, "1000", "0")
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 1980 * decimal.One)
+	assert.Equal(t, len(ex.orderbooks[MarketETH].Trades), 0)
+
+	// Off the tick size
+	rec = amendTestOrder(t, ex, bid.OrderID, "990.005", "0")
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 1980 * decimal.One)
+
+	assert.Equal(t, amendTestOrder(t, ex, 12345, "1000", "1").Code, http.StatusBadRequest)
+
+	// Not resting anymore
+	assert.True(t, ex.cancelOrder(bid.OrderID))
+	assert.Equal(t, amendTestOrder(t, ex, bid.OrderID, "990", "1").Code, http.StatusBadRequest)
+	assert.Nil(t, ex.ledger.verify())
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Most orders a single batch can place
+const maxBatchSize = 50
+
+type (
+	// With AllOrNothing the batch is validated as a whole before any order is
+	// placed, including the funds it needs. Its orders have to be limit
+	// orders resting in the book, an order which would cross the book gets
+	// the whole batch rejected. The orders are placed with every book of the
+	// batch locked, so nothing trades against them before all of them are in.
+	PlaceOrdersRequest struct {
+		Orders 				[]PlaceOrderRequest
+		AllOrNothing 	bool
+	}
+
+	// Result of each order of the batch, in the order of the request
+	PlaceOrderResult struct {
+		Order *PlaceOrderResponse
+		Error string
+		Code 	string `json:",omitempty"`
+	}
+
+	PlaceOrdersResponse struct {
+		Results []PlaceOrderResult
+	}
+)
+
+func (ex *Exchange) handlePlaceOrders(c echo.Context) error {
+	var batch PlaceOrdersRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&batch); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request"})
+	}
+
+	if len(batch.Orders) == 0 || len(batch.Orders) > maxBatchSize {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("a batch holds between 1 and %d orders", maxBatchSize)})
+	}
+
+	resp, err := ex.placeOrders(batch)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (ex *Exchange) placeOrders(batch PlaceOrdersRequest) (*PlaceOrdersResponse, error) {
+	resp := &PlaceOrdersResponse{
+		Results: make([]PlaceOrderResult, len(batch.Orders)),
+	}
+
+	if batch.AllOrNothing {
+		if ex.validateAllOrNothing(batch.Orders, resp.Results) {
+			if err := ex.placeAllOrNothing(batch.Orders, resp.Results); err != nil {
+				return nil, err
+			}
+		}
+		for i := range resp.Results {
+			if resp.Results[i].Order == nil && resp.Results[i].Error == "" {
+				resp.Results[i].Error = "batch rejected"
+			}
+		}
+		return resp, nil
+	}
+
+	for i, p := range batch.Orders {
+		placed, err := ex.placeOrder(p)
+
+		var rejected *RejectedOrderError
+		if errors.As(err, &rejected) {
+			resp.Results[i].Error = err.Error()
+			resp.Results[i].Code = rejected.Code
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Results[i].Order = placed
+	}
+
+	return resp, nil
+}
+
+// validateAllOrNothing checks the orders of an all-or-nothing batch before
+// any of them is placed: they have to rest in the book without crossing
+// each other, and the available balances have to cover all of them
+func (ex *Exchange) validateAllOrNothing(orders []PlaceOrderRequest, results []PlaceOrderResult) bool {
+	valid := true
+	required := make(map[int64]map[string]decimal.Decimal)
+	assets := make([]string, len(orders))
+
+	for i, p := range orders {
+		var err error
+		if p.Type != LimitOrder || p.TimeInForce == orderbook.ImmediateOrCancel || p.TimeInForce == orderbook.FillOrKill {
+			err = rejectRequest("only limit orders resting in the book can be placed all or nothing")
+		}
+		if err == nil {
+			err = ex.validateOrder(p)
+		}
+		if err == nil {
+			err = crossesBatch(orders[:i], p)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			valid = false
+			continue
+		}
+
+		spec, _ := ex.markets.Get(p.Market)
+		asset, amount := spec.BaseAsset, p.Size
+		if p.Bid {
+			// Can't overflow, the notional was checked with the market
+			asset, amount = spec.QuoteAsset, p.Size.Mul(p.Price)
+		}
+		assets[i] = asset
+
+		if required[p.UserID] == nil {
+			required[p.UserID] = make(map[string]decimal.Decimal)
+		}
+		required[p.UserID][asset] += amount
+	}
+	if !valid {
+		return false
+	}
+
+	for i, p := range orders {
+		err := ex.ledger.covers(p.UserID, assets[i], required[p.UserID][assets[i]])
+		if err != nil {
+			results[i].Error = err.Error()
+			results[i].Code = ErrCodeInsufficientFunds
+			valid = false
+		}
+	}
+
+	return valid
+}
+
+// crossesBatch rejects an order which would trade with an order placed
+// before it in the same batch
+func crossesBatch(placed []PlaceOrderRequest, p PlaceOrderRequest) error {
+	for i, o := range placed {
+		if o.Market != p.Market || o.Bid == p.Bid {
+			continue
+		}
+
+		bid, ask := p.Price, o.Price
+		if !p.Bid {
+			bid, ask = o.Price, p.Price
+		}
+		if bid >= ask {
+			return rejectRequest(fmt.Sprintf("order crosses order %d of the batch", i))
+		}
+	}
+
+	return nil
+}
+
+// placeAllOrNothing places the orders of a validated all-or-nothing batch:
+// the funds of every order are held first, then all of them are placed in
+// their books at once. On any error the orders created so far are rejected,
+// which releases their holds.
+func (ex *Exchange) placeAllOrNothing(batch []PlaceOrderRequest, results []PlaceOrderResult) error {
+	orders := make([]*orderbook.Order, 0, len(batch))
+	reject := func(i int, err error) error {
+		for j, order := range orders {
+			reason := "batch rejected"
+			if j == i {
+				reason = err.Error()
+			}
+			ex.records.finish(order.ID, StatusRejected, reason)
+		}
+
+		var rejected *RejectedOrderError
+		if !errors.As(err, &rejected) {
+			return err
+		}
+		results[i].Error = err.Error()
+		results[i].Code = rejected.Code
+
+		return nil
+	}
+
+	resting := make([]orderbook.RestingOrder, 0, len(batch))
+	for i, p := range batch {
+		order, _, err := ex.newOrder(p)
+		if order == nil && err == nil {
+			err = rejectRequest(fmt.Sprintf("order with client order ID %s was already placed", p.ClientOrderID))
+		}
+		if err != nil {
+			return reject(i, err)
+		}
+
+		orders = append(orders, order)
+		resting = append(resting, orderbook.RestingOrder{
+			Book: 	ex.orderbooks[Market(p.Market)],
+			Price: 	p.Price,
+			Order: 	order,
+		})
+	}
+
+	// Every book of the batch, locked in the order of the configuration
+	books := []*orderbook.Orderbook{}
+	for _, spec := range ex.markets.All() {
+		for _, p := range batch {
+			if Market(p.Market) == spec.Market {
+				books = append(books, ex.orderbooks[spec.Market])
+				break
+			}
+		}
+	}
+
+	if i, err := orderbook.PlaceRestingOrders(books, resting); err != nil {
+		return reject(i, rejectRequest(err.Error()))
+	}
+
+	ex.mu.Lock()
+	for _, order := range orders {
+		ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+	}
+	ex.mu.Unlock()
+
+	for i, order := range orders {
+		ex.records.placed(order)
+
+		results[i].Order = newPlaceOrderResponse(order, []orderbook.Match{}, nil)
+		ex.records.setResult(order.ID, results[i].Order)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"count": len(orders),
+	}).Info("Placed all-or-nothing batch")
+
+	return nil
+}
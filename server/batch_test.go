@@ -0,0 +1,155 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertNothingLocked(t *testing.T, ex *Exchange, userID int64) {
+	for _, b := range ex.ledger.balancesOf(userID) {
+		assert.Equal(t, b.Locked, decimal.Zero, b.Asset)
+	}
+}
+
+func TestPlaceOrdersAllOrNothingFunds(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	// 6M + 5M USD against the 10M the user has, each order alone is funded
+	resp, err := ex.placeOrders(PlaceOrdersRequest{
+		Orders: []PlaceOrderRequest{
+			limitOrder(8, true, "1000", "6000"),
+			limitOrder(8, true, "1000", "5000"),
+			limitOrder(8, false, "1", "7000"),
+		},
+		AllOrNothing: true,
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, resp.Results[0].Code, ErrCodeInsufficientFunds)
+	assert.Equal(t, resp.Results[1].Code, ErrCodeInsufficientFunds)
+	assert.Equal(t, resp.Results[2].Error, "batch rejected")
+	for _, result := range resp.Results {
+		assert.Nil(t, result.Order)
+	}
+	assert.Equal(t, len(ex.Orders[8]), 0)
+	assertNothingLocked(t, ex, 8)
+}
+
+func TestPlaceOrdersAllOrNothingCrossing(t *testing.T) {
+	ex := newTwoMarketExchange(t)
+
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	placeTestOrder(t, ex, btcOrder(1, true, "1", "20000"))
+
+	tests := [][]PlaceOrderRequest{
+		// Would take the resting ask, the batch is rejected instead
+		{limitOrder(8, true, "1", "990"), limitOrder(8, true, "1", "1000")},
+		// Same across markets, the ETH order is removed again
+		{limitOrder(8, true, "1", "990"), btcOrder(8, false, "1", "19000")},
+	}
+	for _, orders := range tests {
+		resp, err := ex.placeOrders(PlaceOrdersRequest{Orders: orders, AllOrNothing: true})
+		assert.Nil(t, err)
+
+		assert.Nil(t, resp.Results[0].Order)
+		assert.Equal(t, resp.Results[0].Error, "batch rejected")
+		assert.Equal(t, resp.Results[1].Error, orderbook.ErrOrderWouldCross.Error())
+
+		assert.Equal(t, len(ex.orderbooks[MarketETH].Orders), 1)
+		assert.Equal(t, len(ex.orderbooks["BTC"].Orders), 1)
+		assert.Equal(t, len(ex.orderbooks[MarketETH].Trades), 0)
+		assert.Equal(t, len(ex.orderbooks["BTC"].Trades), 0)
+		assert.Equal(t, len(ex.Orders[8]), 0)
+		assertNothingLocked(t, ex, 8)
+	}
+}
+
+func TestPlaceOrdersAllOrNothingRollback(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	p := limitOrder(8, true, "1", "980")
+	p.ClientOrderID = "first"
+	placeTestOrder(t, ex, p)
+
+	// The second order is a resubmission, the first one gets its hold back
+	resp, err := ex.placeOrders(PlaceOrdersRequest{
+		Orders: []PlaceOrderRequest{
+			limitOrder(8, true, "1", "990"),
+			p,
+		},
+		AllOrNothing: true,
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, resp.Results[0].Error, "batch rejected")
+	assert.Equal(t, resp.Results[1].Error, "order with client order ID first was already placed")
+	assert.Equal(t, len(ex.Orders[8]), 1)
+	assert.Equal(t, len(ex.ledger.holds), 1)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 980 * decimal.One)
+	assert.Nil(t, ex.ledger.verify())
+}
+
+func TestPlaceOrdersAllOrNothingValidation(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	market := PlaceOrderRequest{Type: MarketOrder, Bid: true, Size: decimal.One, Market: MarketETH, UserID: 8}
+	resp, err := ex.placeOrders(PlaceOrdersRequest{
+		Orders: []PlaceOrderRequest{
+			limitOrder(8, true, "1", "990"),
+			limitOrder(8, false, "1", "985"),
+			market,
+		},
+		AllOrNothing: true,
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, resp.Results[0].Error, "batch rejected")
+	assert.Equal(t, resp.Results[1].Error, "order crosses order 0 of the batch")
+	assert.Equal(t, resp.Results[2].Error, "only limit orders resting in the book can be placed all or nothing")
+	assert.Equal(t, len(ex.Orders[8]), 0)
+}
+
+func TestPlaceOrdersAllOrNothing(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	resp, err := ex.placeOrders(PlaceOrdersRequest{
+		Orders: []PlaceOrderRequest{
+			limitOrder(8, true, "1", "990"),
+			limitOrder(8, true, "1", "980"),
+			limitOrder(8, false, "1", "1010"),
+		},
+		AllOrNothing: true,
+	})
+	assert.Nil(t, err)
+
+	for _, result := range resp.Results {
+		assert.Equal(t, result.Error, "")
+		assert.NotNil(t, result.Order)
+	}
+	assert.Equal(t, len(ex.Orders[8]), 3)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 1970 * decimal.One)
+
+	record, _ := ex.records.get(resp.Results[0].Order.OrderID)
+	assert.Equal(t, record.Status, StatusNew)
+}
+
+func TestPlaceOrdersIndependently(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	resp, err := ex.placeOrders(PlaceOrdersRequest{
+		Orders: []PlaceOrderRequest{
+			limitOrder(8, true, "1", "990"),
+			limitOrder(8, true, "1000", "20000"),
+			limitOrder(8, false, "1", "1010"),
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.NotNil(t, resp.Results[0].Order)
+	assert.Equal(t, resp.Results[1].Code, ErrCodeInsufficientFunds)
+	assert.NotNil(t, resp.Results[2].Order)
+	assert.Equal(t, len(ex.Orders[8]), 2)
+}
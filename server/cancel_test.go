@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleCancelOrders(t *testing.T) {
+	ex := newTwoMarketExchange(t)
+
+	ethBid := placeTestOrder(t, ex, limitOrder(8, true, "1", "990"))
+	ethAsk := placeTestOrder(t, ex, limitOrder(8, false, "1", "1010"))
+	btcBid := placeTestOrder(t, ex, btcOrder(8, true, "1", "20000"))
+	other := placeTestOrder(t, ex, limitOrder(1, true, "1", "990"))
+
+	cancel := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/orders?"+query, nil), rec)
+		assert.Nil(t, ex.handleCancelOrders(c))
+		return rec
+	}
+
+	assert.Equal(t, cancel("userID=8&market=SOL").Code, http.StatusBadRequest)
+	assert.Equal(t, cancel("userID=8&side=BUY").Code, http.StatusBadRequest)
+
+	rec := cancel("userID=8&side=BID")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	var resp CancelOrdersResponse
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.ElementsMatch(t, resp.OrderIDs, []int64{ethBid.OrderID, btcBid.OrderID})
+
+	// Every market at once
+	rec = cancel("userID=8")
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, resp.OrderIDs, []int64{ethAsk.OrderID})
+
+	for _, id := range []int64{ethBid.OrderID, ethAsk.OrderID, btcBid.OrderID} {
+		record, _ := ex.records.get(id)
+		assert.Equal(t, record.Status, StatusCancelled)
+	}
+	record, _ := ex.records.get(other.OrderID)
+	assert.Equal(t, record.Status, StatusNew)
+
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, decimal.Zero)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "ETH").Locked, decimal.Zero)
+	assert.Equal(t, len(ex.Orders[8]), 0)
+	assert.Nil(t, ex.ledger.verify())
+}
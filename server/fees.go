@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+)
+
+const (
+	// Account the fees are credited to, it also pays the maker rebates
+	exchangeAccount int64 = 0
+
+	// Optional configuration of the fees, DefaultFeeSchedule is used without it
+	feesConfigFile = "fees.json"
+
+	// Trading volume deciding the fee tier of a user
+	feeVolumeWindow = 30 * 24 * time.Hour
+)
+
+type (
+	// Rates applied to the users who traded at least MinVolume over the
+	// window, in quote asset units summed over all the markets
+	FeeTier struct {
+		MinVolume decimal.Decimal
+		// In basis points of what the user receives, a negative maker rate is a rebate
+		MakerBps 	int64
+		TakerBps 	int64
+	}
+
+	// Tiers sorted by volume, the first one starts at 0
+	FeeSchedule struct {
+		Tiers []FeeTier
+	}
+
+	// Fees charged on both sides of a trade, each in the asset its side
+	// received. A maker rebate is paid in the asset of the taker fee instead.
+	tradeFees struct {
+		maker 			decimal.Decimal
+		makerAsset 	string
+		taker 			decimal.Decimal
+		takerAsset 	string
+	}
+
+	volumeEntry struct {
+		at 				int64
+		notional 	decimal.Decimal
+	}
+
+	// Rolling trading volume of every user
+	feeTracker struct {
+		mu 				sync.Mutex
+		schedule 	FeeSchedule
+		trades 		map[int64][]volumeEntry
+		volumes 	map[int64]decimal.Decimal
+	}
+)
+
+var DefaultFeeSchedule = FeeSchedule{
+	Tiers: []FeeTier{
+		{MinVolume: 0, MakerBps: 10, TakerBps: 20},
+		{MinVolume: 1_000_000 * decimal.One, MakerBps: 5, TakerBps: 15},
+		{MinVolume: 10_000_000 * decimal.One, MakerBps: -1, TakerBps: 10},
+	},
+}
+
+// LoadFeeSchedule reads the fee schedule from a JSON FeeSchedule,
+// DefaultFeeSchedule is returned when the file doesn't exist
+func LoadFeeSchedule(path string) (FeeSchedule, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultFeeSchedule, nil
+	}
+	if err != nil {
+		return FeeSchedule{}, err
+	}
+
+	var schedule FeeSchedule
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		return FeeSchedule{}, fmt.Errorf("invalid fees configuration %s: %w", path, err)
+	}
+
+	return schedule, nil
+}
+
+// validate checks that the tiers are sorted and that a maker rebate is
+// always paid for by the taker fee on the other side of the trade. Both
+// are in the same asset and on the same amount, so the rebate rate being
+// at most the lowest taker rate is enough.
+func (s FeeSchedule) validate() error {
+	if len(s.Tiers) == 0 || s.Tiers[0].MinVolume != 0 {
+		return fmt.Errorf("the first fee tier has to start at volume 0")
+	}
+
+	minTakerBps := s.Tiers[0].TakerBps
+	for _, tier := range s.Tiers {
+		minTakerBps = min(minTakerBps, tier.TakerBps)
+	}
+
+	for i, tier := range s.Tiers {
+		if i > 0 && tier.MinVolume <= s.Tiers[i-1].MinVolume {
+			return fmt.Errorf("fee tiers have to be sorted by increasing volume")
+		}
+		if tier.TakerBps < 0 || tier.TakerBps >= 10_000 || tier.MakerBps >= 10_000 {
+			return fmt.Errorf("fee rates have to be below 10000 bps and taker rates positive")
+		}
+		if -tier.MakerBps > minTakerBps {
+			return fmt.Errorf("maker rebate of %d bps is above the lowest taker fee of %d bps", -tier.MakerBps, minTakerBps)
+		}
+	}
+
+	return nil
+}
+
+func newFeeTracker(schedule FeeSchedule) (*feeTracker, error) {
+	if err := schedule.validate(); err != nil {
+		return nil, err
+	}
+
+	return &feeTracker{
+		schedule: schedule,
+		trades: 	make(map[int64][]volumeEntry),
+		volumes: 	make(map[int64]decimal.Decimal),
+	}, nil
+}
+
+// tier returns the tier of a user from its volume over the window
+func (f *feeTracker) tier(userID int64, now int64) FeeTier {
+	trades := f.trades[userID]
+
+	cutoff := now - int64(feeVolumeWindow)
+	i := 0
+	for ; i < len(trades) && trades[i].at < cutoff; i++ {
+		f.volumes[userID] -= trades[i].notional
+	}
+	f.trades[userID] = trades[i:]
+
+	tier := f.schedule.Tiers[0]
+	for _, t := range f.schedule.Tiers {
+		if f.volumes[userID] >= t.MinVolume {
+			tier = t
+		}
+	}
+
+	return tier
+}
+
+func (f *feeTracker) addVolume(userID int64, now int64, notional decimal.Decimal) {
+	f.trades[userID] = append(f.trades[userID], volumeEntry{at: now, notional: notional})
+	f.volumes[userID] += notional
+}
+
+// charge returns the fees of a trade at the tiers of its maker and taker,
+// then counts the trade in their volume
+func (f *feeTracker) charge(spec MarketSpec, trade *orderbook.Trade) tradeFees {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	notional := trade.Size.Mul(trade.Price)
+
+	makerTier := f.tier(trade.MakerUserID, now)
+	takerTier := f.tier(trade.TakerUserID, now)
+
+	// The buyer receives the base asset and the seller the quote asset
+	makerReceived, makerAsset := notional, spec.QuoteAsset
+	takerReceived, takerAsset := trade.Size, spec.BaseAsset
+	if !trade.Bid {
+		makerReceived, makerAsset = trade.Size, spec.BaseAsset
+		takerReceived, takerAsset = notional, spec.QuoteAsset
+	}
+
+	fees := tradeFees{
+		maker: 			makerReceived.MulDiv(makerTier.MakerBps, 10_000),
+		makerAsset: makerAsset,
+		taker: 			takerReceived.MulDiv(takerTier.TakerBps, 10_000),
+		takerAsset: takerAsset,
+	}
+	// A rebate comes out of the taker fee, so it is paid in the same asset
+	if makerTier.MakerBps < 0 {
+		fees.maker = takerReceived.MulDiv(makerTier.MakerBps, 10_000)
+		fees.makerAsset = takerAsset
+	}
+
+	f.addVolume(trade.MakerUserID, now, notional)
+	f.addVolume(trade.TakerUserID, now, notional)
+
+	return fees
+}
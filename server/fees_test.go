@@ -0,0 +1,98 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeScheduleValidate(t *testing.T) {
+	assert.Nil(t, DefaultFeeSchedule.validate())
+
+	invalid := []FeeSchedule{
+		{},
+		{Tiers: []FeeTier{{MinVolume: decimal.One, TakerBps: 10}}},
+		{Tiers: []FeeTier{{TakerBps: 10}, {MinVolume: 5 * decimal.One, TakerBps: 5}, {MinVolume: 2 * decimal.One, TakerBps: 5}}},
+		{Tiers: []FeeTier{{TakerBps: -1}}},
+		{Tiers: []FeeTier{{MakerBps: 10_000, TakerBps: 10}}},
+		// The rebate is above the lowest taker fee, which is in another tier
+		{Tiers: []FeeTier{{TakerBps: 10}, {MinVolume: decimal.One, MakerBps: -6, TakerBps: 5}}},
+	}
+	for _, schedule := range invalid {
+		assert.NotNil(t, schedule.validate(), schedule)
+	}
+}
+
+func TestFeeTiers(t *testing.T) {
+	f, err := newFeeTracker(DefaultFeeSchedule)
+	assert.Nil(t, err)
+
+	now := time.Now().UnixNano()
+	assert.Equal(t, f.tier(1, now), DefaultFeeSchedule.Tiers[0])
+
+	f.addVolume(1, now, 1_000_000 * decimal.One)
+	assert.Equal(t, f.tier(1, now), DefaultFeeSchedule.Tiers[1])
+
+	f.addVolume(1, now, 9_000_000 * decimal.One)
+	assert.Equal(t, f.tier(1, now), DefaultFeeSchedule.Tiers[2])
+
+	// The volume only counts over the window
+	later := now + int64(feeVolumeWindow) + 1
+	assert.Equal(t, f.tier(1, later), DefaultFeeSchedule.Tiers[0])
+	assert.Equal(t, f.volumes[1], decimal.Zero)
+}
+
+func TestFeeCharge(t *testing.T) {
+	spec := DefaultMarkets[0]
+	f, err := newFeeTracker(DefaultFeeSchedule)
+	assert.Nil(t, err)
+
+	// The taker buys, it receives ETH and the maker USD
+	trade := &orderbook.Trade{
+		MakerUserID: 	1,
+		TakerUserID: 	8,
+		Price: 				1000 * decimal.One,
+		Size: 				2 * decimal.One,
+		Bid: 					true,
+	}
+	fees := f.charge(spec, trade)
+	assert.Equal(t, fees.taker, decimal.MustParse("0.004"))
+	assert.Equal(t, fees.takerAsset, "ETH")
+	assert.Equal(t, fees.maker, 2 * decimal.One)
+	assert.Equal(t, fees.makerAsset, "USD")
+
+	trade.Bid = false
+	fees = f.charge(spec, trade)
+	assert.Equal(t, fees.taker, 4 * decimal.One)
+	assert.Equal(t, fees.takerAsset, "USD")
+	assert.Equal(t, fees.maker, decimal.MustParse("0.002"))
+	assert.Equal(t, fees.makerAsset, "ETH")
+}
+
+func TestMakerRebate(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	schedule := FeeSchedule{Tiers: []FeeTier{{MakerBps: -5, TakerBps: 10}}}
+	fees, err := newFeeTracker(schedule)
+	assert.Nil(t, err)
+	ex.fees = fees
+
+	placeTestOrder(t, ex, limitOrder(1, false, "10", "1000"))
+	taker := placeTestOrder(t, ex, limitOrder(8, true, "10", "1000"))
+	assert.Equal(t, taker.Fee, decimal.MustParse("0.01"))
+	assert.Equal(t, taker.FeeAsset, "ETH")
+
+	// The rebate is paid in ETH out of the taker fee, the exchange keeps the rest
+	makerFills, err := ex.fills.query(1, FillsQuery{Limit: defaultFillsLimit})
+	assert.Nil(t, err)
+	assert.Equal(t, makerFills.Fills[0].Fee, decimal.MustParse("-0.005"))
+	assert.Equal(t, makerFills.Fills[0].FeeAsset, "ETH")
+
+	assert.Equal(t, balanceOf(ex.ledger, exchangeAccount, "ETH").Available, decimal.MustParse("0.005"))
+	assert.Equal(t, balanceOf(ex.ledger, exchangeAccount, "USD").Available, decimal.Zero)
+	assert.Equal(t, balanceOf(ex.ledger, 1, "ETH").Available, 990 * decimal.One + decimal.MustParse("0.005"))
+	assert.Nil(t, ex.ledger.verify())
+}
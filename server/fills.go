@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MakerLiquidity Liquidity = "MAKER"
+	TakerLiquidity Liquidity = "TAKER"
+
+	defaultFillsLimit = 100
+	maxFillsLimit     = 1_000
+)
+
+type (
+	// Whether a fill added liquidity to the book or took it
+	Liquidity string
+
+	// One side of a trade, as seen by the user who got filled
+	Fill struct {
+		TradeID 	int64
+		OrderID 	int64
+		UserID 		int64
+		Market 		Market
+		Side 			string // BID or ASK
+		Price 		decimal.Decimal
+		Size 			decimal.Decimal
+		// Charged in the asset received, negative for a maker rebate which
+		// is paid in the asset of the taker fee
+		Fee 			decimal.Decimal
+		FeeAsset 	string
+		Liquidity Liquidity
+		Timestamp int64
+	}
+
+	GetFillsResponse struct {
+		// Most recent fills first
+		Fills 			[]*Fill
+		// Cursor of the next page, empty on the last one
+		NextCursor 	string
+	}
+
+	FillsQuery struct {
+		Market 	Market
+		// Unix nano time range, bounds are inclusive and 0 means unbounded
+		Start 	int64
+		End 		int64
+		Cursor 	string
+		Limit 	int
+	}
+
+	// Fills of every user, in the order they happened
+	fillIndex struct {
+		mu 		sync.RWMutex
+		fills map[int64][]*Fill
+	}
+)
+
+func newFillIndex() *fillIndex {
+	return &fillIndex{
+		fills: make(map[int64][]*Fill),
+	}
+}
+
+// record adds the maker and taker fills of the trades of matches,
+// with their fees by trade ID
+func (idx *fillIndex) record(matches []orderbook.Match, fees map[int64]tradeFees) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, match := range matches {
+		trade := match.Trade
+		if trade == nil {
+			continue
+		}
+
+		makerSide := "ASK"
+		if !trade.Bid {
+			makerSide = "BID"
+		}
+		tf := fees[trade.ID]
+
+		idx.add(&Fill{
+			TradeID: 		trade.ID,
+			OrderID: 		trade.MakerOrderID,
+			UserID: 		trade.MakerUserID,
+			Market: 		Market(trade.Market),
+			Side: 			makerSide,
+			Price: 			trade.Price,
+			Size: 			trade.Size,
+			Fee: 				tf.maker,
+			FeeAsset: 	tf.makerAsset,
+			Liquidity: 	MakerLiquidity,
+			Timestamp: 	trade.Timestamp,
+		})
+		idx.add(&Fill{
+			TradeID: 		trade.ID,
+			OrderID: 		trade.TakerOrderID,
+			UserID: 		trade.TakerUserID,
+			Market: 		Market(trade.Market),
+			Side: 			trade.AggressorSide,
+			Price: 			trade.Price,
+			Size: 			trade.Size,
+			Fee: 				tf.taker,
+			FeeAsset: 	tf.takerAsset,
+			Liquidity: 	TakerLiquidity,
+			Timestamp: 	trade.Timestamp,
+		})
+	}
+}
+
+func (idx *fillIndex) add(fill *Fill) {
+	idx.fills[fill.UserID] = append(idx.fills[fill.UserID], fill)
+}
+
+// query returns a page of the fills of userID, from the most recent one.
+// The cursor is the position in the user's fills where the page starts,
+// which stays valid as the fills are only ever appended.
+func (idx *fillIndex) query(userID int64, q FillsQuery) (*GetFillsResponse, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	fills := idx.fills[userID]
+
+	from := len(fills)
+	if q.Cursor != "" {
+		cursor, err := strconv.Atoi(q.Cursor)
+		if err != nil || cursor < 0 || cursor > len(fills) {
+			return nil, fmt.Errorf("invalid cursor: %s", q.Cursor)
+		}
+		from = cursor
+	}
+
+	resp := &GetFillsResponse{
+		Fills: []*Fill{},
+	}
+
+	for i := from - 1; i >= 0; i-- {
+		if len(resp.Fills) == q.Limit {
+			resp.NextCursor = strconv.Itoa(i + 1)
+			break
+		}
+
+		fill := fills[i]
+		if q.Start != 0 && fill.Timestamp < q.Start || q.End != 0 && fill.Timestamp > q.End {
+			continue
+		}
+		if q.Market != "" && fill.Market != q.Market {
+			continue
+		}
+
+		resp.Fills = append(resp.Fills, fill)
+	}
+
+	return resp, nil
+}
+
+func (ex *Exchange) handleGetFills(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user ID"})
+	}
+
+	q, err := ex.parseFillsQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	resp, err := ex.fills.query(int64(userID), q)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (ex *Exchange) parseFillsQuery(c echo.Context) (FillsQuery, error) {
+	q := FillsQuery{
+		Market: Market(c.QueryParam("market")),
+		Cursor: c.QueryParam("cursor"),
+		Limit: 	defaultFillsLimit,
+	}
+
+	if q.Market != "" {
+		if _, ok := ex.markets.Get(q.Market); !ok {
+			return q, fmt.Errorf("market not found")
+		}
+	}
+
+	for param, value := range map[string]*int64{"start": &q.Start, "end": &q.End} {
+		str := c.QueryParam(param)
+		if str == "" {
+			continue
+		}
+		t, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || t < 0 {
+			return q, fmt.Errorf("invalid %s: %s", param, str)
+		}
+		*value = t
+	}
+
+	if q.End != 0 && q.End < q.Start {
+		return q, fmt.Errorf("end must be after start")
+	}
+
+	if str := c.QueryParam("limit"); str != "" {
+		limit, err := strconv.Atoi(str)
+		if err != nil || limit <= 0 || limit > maxFillsLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxFillsLimit)
+		}
+		q.Limit = limit
+	}
+
+	return q, nil
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFillsPagination(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	placeTestOrder(t, ex, limitOrder(1, false, "2", "1001"))
+	placeTestOrder(t, ex, limitOrder(1, false, "3", "1002"))
+	taker := placeTestOrder(t, ex, limitOrder(8, true, "6", "1002"))
+	assert.Equal(t, taker.SizeFilled, 6 * decimal.One)
+
+	page, err := ex.fills.query(8, FillsQuery{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, len(page.Fills), 2)
+	// Most recent first
+	assert.Equal(t, page.Fills[0].Price, decimal.MustParse("1002"))
+	assert.Equal(t, page.Fills[1].Price, decimal.MustParse("1001"))
+	assert.Equal(t, page.Fills[0].Liquidity, TakerLiquidity)
+	assert.Equal(t, page.Fills[0].OrderID, taker.OrderID)
+	assert.NotEqual(t, page.NextCursor, "")
+
+	page, err = ex.fills.query(8, FillsQuery{Limit: 2, Cursor: page.NextCursor})
+	assert.Nil(t, err)
+	assert.Equal(t, len(page.Fills), 1)
+	assert.Equal(t, page.Fills[0].Price, decimal.MustParse("1000"))
+	assert.Equal(t, page.NextCursor, "")
+
+	makerFills, err := ex.fills.query(1, FillsQuery{Limit: defaultFillsLimit})
+	assert.Nil(t, err)
+	assert.Equal(t, len(makerFills.Fills), 3)
+	for _, fill := range makerFills.Fills {
+		assert.Equal(t, fill.Liquidity, MakerLiquidity)
+		assert.Equal(t, fill.Side, "ASK")
+	}
+
+	_, err = ex.fills.query(8, FillsQuery{Limit: 2, Cursor: "4"})
+	assert.NotNil(t, err)
+}
+
+func TestFillsTimeRange(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	placeTestOrder(t, ex, limitOrder(8, true, "1", "1000"))
+	first, err := ex.fills.query(8, FillsQuery{Limit: 1})
+	assert.Nil(t, err)
+	at := first.Fills[0].Timestamp
+
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	placeTestOrder(t, ex, limitOrder(8, true, "1", "1000"))
+
+	page, err := ex.fills.query(8, FillsQuery{End: at, Limit: defaultFillsLimit})
+	assert.Nil(t, err)
+	assert.Equal(t, len(page.Fills), 1)
+
+	page, err = ex.fills.query(8, FillsQuery{Start: at + 1, Limit: defaultFillsLimit})
+	assert.Nil(t, err)
+	assert.Equal(t, len(page.Fills), 1)
+
+	page, err = ex.fills.query(8, FillsQuery{Market: "BTC", Limit: defaultFillsLimit})
+	assert.Nil(t, err)
+	assert.Equal(t, len(page.Fills), 0)
+}
@@ -0,0 +1,516 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Code of the orders rejected because the user can't pay for them
+const ErrCodeInsufficientFunds = "INSUFFICIENT_FUNDS"
+
+// How often the ledger invariants are verified
+const ledgerAuditInterval = 10 * time.Second
+
+// Account on the other side of deposits and withdrawals, its balance is
+// what left the exchange minus what came in
+const externalAccount int64 = -1
+
+// Deposited for the demo users when the exchange starts
+var startingBalances = map[string]decimal.Decimal{
+	"ETH": 1_000 * decimal.One,
+	"USD": 10_000_000 * decimal.One,
+}
+
+type (
+	// What an account owns of an asset. Available can be traded or
+	// withdrawn, locked is held by the open orders of the account.
+	Balance struct {
+		Asset 		string
+		Available decimal.Decimal
+		Locked 		decimal.Decimal
+	}
+
+	GetBalancesResponse struct {
+		Balances []Balance
+	}
+
+	// One side of a transaction, a positive amount credits the account
+	// and a negative one debits it
+	entry struct {
+		account int64
+		asset 	string
+		amount 	decimal.Decimal
+		// Applied to the locked balance instead of the available one
+		locked 	bool
+	}
+
+	// Funds locked by an open order until it fills or leaves the book
+	hold struct {
+		account int64
+		asset 	string
+		amount 	decimal.Decimal
+		// Limit price of a bid, its hold is kept at the remaining size at
+		// that price. 0 for the other orders.
+		price 	decimal.Decimal
+	}
+
+	// Balances of every account, only ever changed by balanced transactions
+	ledger struct {
+		mu 					sync.RWMutex
+		balances 		map[int64]map[string]*Balance
+		deposits 		map[string]decimal.Decimal
+		withdrawals map[string]decimal.Decimal
+		// Holds by order ID
+		holds 			map[int64]*hold
+	}
+
+	// The available balance doesn't cover what an order or a withdrawal needs
+	InsufficientFundsError struct {
+		Asset 		string
+		Available decimal.Decimal
+		Required 	decimal.Decimal
+	}
+)
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("insufficient %s balance: %s available, %s required", e.Asset, e.Available, e.Required)
+}
+
+func newLedger() *ledger {
+	return &ledger{
+		balances: 		make(map[int64]map[string]*Balance),
+		deposits: 		make(map[string]decimal.Decimal),
+		withdrawals: 	make(map[string]decimal.Decimal),
+		holds: 				make(map[int64]*hold),
+	}
+}
+
+func (l *ledger) balance(account int64, asset string) *Balance {
+	assets, ok := l.balances[account]
+	if !ok {
+		assets = make(map[string]*Balance)
+		l.balances[account] = assets
+	}
+
+	b, ok := assets[asset]
+	if !ok {
+		b = &Balance{Asset: asset}
+		assets[asset] = b
+	}
+
+	return b
+}
+
+// post applies the entries of a transaction, which has to be balanced:
+// the entries of each asset sum to zero
+func (l *ledger) post(entries ...entry) error {
+	sums := make(map[string]decimal.Decimal)
+	for _, e := range entries {
+		sums[e.asset] += e.amount
+	}
+	for asset, sum := range sums {
+		if sum != 0 {
+			return fmt.Errorf("unbalanced transaction: %s entries sum to %s", asset, sum)
+		}
+	}
+
+	for _, e := range entries {
+		b := l.balance(e.account, e.asset)
+		if e.locked {
+			b.Locked += e.amount
+		} else {
+			b.Available += e.amount
+		}
+	}
+
+	return nil
+}
+
+func (l *ledger) deposit(userID int64, asset string, amount decimal.Decimal) error {
+	if amount <= 0 {
+		return fmt.Errorf("invalid deposit amount: %s", amount)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.post(
+		entry{account: externalAccount, asset: asset, amount: -amount},
+		entry{account: userID, asset: asset, amount: amount},
+	)
+	if err != nil {
+		return err
+	}
+	l.deposits[asset] += amount
+
+	return nil
+}
+
+func (l *ledger) withdraw(userID int64, asset string, amount decimal.Decimal) error {
+	if amount <= 0 {
+		return fmt.Errorf("invalid withdrawal amount: %s", amount)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if available := l.balance(userID, asset).Available; available < amount {
+		return &InsufficientFundsError{Asset: asset, Available: available, Required: amount}
+	}
+
+	err := l.post(
+		entry{account: userID, asset: asset, amount: -amount},
+		entry{account: externalAccount, asset: asset, amount: amount},
+	)
+	if err != nil {
+		return err
+	}
+	l.withdrawals[asset] += amount
+
+	return nil
+}
+
+// settleTrade moves the base asset from the seller to the buyer and the
+// quote asset the other way around. What each side pays comes out of the
+// hold of its order first, the available balance covers the rest if it can. The fees
+// go from what each side received to the exchange account, which pays the
+// maker rebates.
+func (l *ledger) settleTrade(spec MarketSpec, trade *orderbook.Trade, fees tradeFees) error {
+	buyer, seller := trade.TakerUserID, trade.MakerUserID
+	buyOrder, sellOrder := trade.TakerOrderID, trade.MakerOrderID
+	if !trade.Bid {
+		buyer, seller = seller, buyer
+		buyOrder, sellOrder = sellOrder, buyOrder
+	}
+	notional := trade.Size.Mul(trade.Price)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []entry{
+		{account: buyer, asset: spec.BaseAsset, amount: trade.Size},
+		{account: seller, asset: spec.QuoteAsset, amount: notional},
+		{account: trade.MakerUserID, asset: fees.makerAsset, amount: -fees.maker},
+		{account: exchangeAccount, asset: fees.makerAsset, amount: fees.maker},
+		{account: trade.TakerUserID, asset: fees.takerAsset, amount: -fees.taker},
+		{account: exchangeAccount, asset: fees.takerAsset, amount: fees.taker},
+	}
+	sold, fromSellHold, err := l.debit(sellOrder, seller, spec.BaseAsset, trade.Size)
+	if err != nil {
+		return err
+	}
+	paid, fromBuyHold, err := l.debit(buyOrder, buyer, spec.QuoteAsset, notional)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, sold...)
+	entries = append(entries, paid...)
+
+	// A bid filled below its limit price gets the difference back
+	improvement := l.improvement(buyOrder, trade, fromBuyHold)
+	if improvement > 0 {
+		entries = append(entries,
+			entry{account: buyer, asset: spec.QuoteAsset, amount: -improvement, locked: true},
+			entry{account: buyer, asset: spec.QuoteAsset, amount: improvement},
+		)
+	}
+
+	if err := l.post(entries...); err != nil {
+		return err
+	}
+	l.consume(sellOrder, fromSellHold)
+	l.consume(buyOrder, fromBuyHold + improvement)
+
+	return nil
+}
+
+// debit returns the entries taking amount from an account on behalf of an
+// order, and how much of it comes out of the hold of the order. The rest
+// comes out of the available balance, which can't go below zero.
+func (l *ledger) debit(orderID, account int64, asset string, amount decimal.Decimal) ([]entry, decimal.Decimal, error) {
+	fromHold := decimal.Zero
+	if h, ok := l.holds[orderID]; ok && h.account == account && h.asset == asset {
+		fromHold = h.amount
+		if fromHold > amount {
+			fromHold = amount
+		}
+	}
+
+	entries := []entry{}
+	if fromHold > 0 {
+		entries = append(entries, entry{account: account, asset: asset, amount: -fromHold, locked: true})
+	}
+	if rest := amount - fromHold; rest > 0 {
+		if available := l.balance(account, asset).Available; rest > available {
+			return nil, decimal.Zero, &InsufficientFundsError{Asset: asset, Available: available, Required: rest}
+		}
+		entries = append(entries, entry{account: account, asset: asset, amount: -rest})
+	}
+
+	return entries, fromHold, nil
+}
+
+// improvement is what the hold of a limit bid keeps above the remaining
+// size at its limit price once a trade took fromHold out of it
+func (l *ledger) improvement(orderID int64, trade *orderbook.Trade, fromHold decimal.Decimal) decimal.Decimal {
+	h, ok := l.holds[orderID]
+	if !ok || h.price <= trade.Price {
+		return decimal.Zero
+	}
+
+	improvement := trade.Size.Mul(h.price - trade.Price)
+	if left := h.amount - fromHold; improvement > left {
+		improvement = left
+	}
+
+	return improvement
+}
+
+func (l *ledger) consume(orderID int64, amount decimal.Decimal) {
+	if h, ok := l.holds[orderID]; ok {
+		h.amount -= amount
+	}
+}
+
+// hold locks amount of the available balance of an account for an order,
+// price is the limit price of a bid and 0 for the other orders
+func (l *ledger) hold(orderID, account int64, asset string, amount, price decimal.Decimal) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.holds[orderID]; ok {
+		return fmt.Errorf("order %d already holds funds", orderID)
+	}
+
+	if err := l.lock(account, asset, amount); err != nil {
+		return err
+	}
+	l.holds[orderID] = &hold{account: account, asset: asset, amount: amount, price: price}
+
+	return nil
+}
+
+// resize changes the amount and the price held by an order, e.g. when it
+// gets amended, and returns what it held before
+func (l *ledger) resize(orderID int64, amount, price decimal.Decimal) (hold, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.holds[orderID]
+	if !ok {
+		return hold{}, fmt.Errorf("order %d holds no funds", orderID)
+	}
+
+	held := *h
+	if err := l.lock(h.account, h.asset, amount-held.amount); err != nil {
+		return held, err
+	}
+	h.amount, h.price = amount, price
+
+	return held, nil
+}
+
+// release unlocks what an order still holds once it is out of the book
+func (l *ledger) release(orderID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.holds[orderID]
+	if !ok {
+		return
+	}
+	delete(l.holds, orderID)
+
+	if err := l.lock(h.account, h.asset, -h.amount); err != nil {
+		logrus.WithError(err).Error("Failed to release the hold of an order")
+	}
+}
+
+// covers checks that the available balance of an account covers amount, without holding it
+func (l *ledger) covers(account int64, asset string, amount decimal.Decimal) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	available := decimal.Zero
+	if b, ok := l.balances[account][asset]; ok {
+		available = b.Available
+	}
+	if available < amount {
+		return &InsufficientFundsError{Asset: asset, Available: available, Required: amount}
+	}
+
+	return nil
+}
+
+// lock moves amount from the available to the locked balance of an
+// account, a negative amount unlocks
+func (l *ledger) lock(account int64, asset string, amount decimal.Decimal) error {
+	if amount == 0 {
+		return nil
+	}
+
+	if available := l.balance(account, asset).Available; amount > available {
+		return &InsufficientFundsError{Asset: asset, Available: available, Required: amount}
+	}
+
+	return l.post(
+		entry{account: account, asset: asset, amount: -amount},
+		entry{account: account, asset: asset, amount: amount, locked: true},
+	)
+}
+
+// verify checks that every asset sums to zero across all the accounts,
+// that what the users and the exchange hold is what was deposited minus
+// what was withdrawn
+// and that the locked balances are the holds of the open orders.
+// It goes over every account, so it only runs in the background with
+// auditLedger, each transaction being balanced on its own by post.
+func (l *ledger) verify() error {
+	total := make(map[string]decimal.Decimal)
+	held := make(map[string]decimal.Decimal)
+	for account, assets := range l.balances {
+		for asset, b := range assets {
+			total[asset] += b.Available + b.Locked
+			if account != externalAccount {
+				held[asset] += b.Available + b.Locked
+			}
+		}
+	}
+
+	locked := make(map[int64]map[string]decimal.Decimal)
+	for _, h := range l.holds {
+		if locked[h.account] == nil {
+			locked[h.account] = make(map[string]decimal.Decimal)
+		}
+		locked[h.account][h.asset] += h.amount
+	}
+	for account, assets := range l.balances {
+		for asset, b := range assets {
+			if b.Locked != locked[account][asset] {
+				return fmt.Errorf("ledger out of balance: account %d locks %s %s, its orders hold %s", account, b.Locked, asset, locked[account][asset])
+			}
+		}
+	}
+
+	for asset, sum := range total {
+		if sum != 0 {
+			return fmt.Errorf("ledger out of balance: %s sums to %s", asset, sum)
+		}
+		if expected := l.deposits[asset] - l.withdrawals[asset]; held[asset] != expected {
+			return fmt.Errorf("ledger out of balance: accounts hold %s %s, deposits minus withdrawals are %s", held[asset], asset, expected)
+		}
+	}
+
+	return nil
+}
+
+// auditLedger verifies the ledger periodically, what breaks its invariants
+// is logged
+func (ex *Exchange) auditLedger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		<- ticker.C
+
+		ex.ledger.mu.RLock()
+		err := ex.ledger.verify()
+		ex.ledger.mu.RUnlock()
+
+		if err != nil {
+			logrus.WithError(err).Error("Ledger audit failed")
+		}
+	}
+}
+
+// balancesOf returns the balances of an account sorted by asset
+func (l *ledger) balancesOf(account int64) []Balance {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := []Balance{}
+	for _, b := range l.balances[account] {
+		balances = append(balances, *b)
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].Asset < balances[j].Asset
+	})
+
+	return balances
+}
+
+// fund deposits the starting balances of a new user
+func (ex *Exchange) fund(userID int64, amounts map[string]decimal.Decimal) {
+	for asset, amount := range amounts {
+		if err := ex.ledger.deposit(userID, asset, amount); err != nil {
+			logrus.Error(err)
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"userID": userID,
+			"asset": 	asset,
+			"amount": amount,
+		}).Info("Deposited")
+	}
+}
+
+// reserve locks the funds an order needs before it reaches the book: the
+// quote amount of a bid at its limit price, the base size of an ask.
+// Market bids are estimated against the current book and stop-market bids
+// at their collar, they can't spend more than that once matched.
+func (ex *Exchange) reserve(p PlaceOrderRequest, order *orderbook.Order) error {
+	spec, _ := ex.markets.Get(p.Market)
+
+	var err error
+	asset, amount, price := spec.BaseAsset, p.Size, decimal.Zero
+	if p.Bid {
+		asset = spec.QuoteAsset
+		switch p.Type {
+		case LimitOrder, StopLimitOrder:
+			amount, err = p.Size.CheckedMul(p.Price)
+			price = p.Price
+		case StopMarketOrder:
+			amount, err = p.Size.CheckedMul(order.WorstPrice)
+			order.Budget = amount
+		case MarketOrder:
+			amount = ex.orderbooks[p.Market].EstimateCost(true, p.Size)
+			if amount == 0 {
+				return ex.rejectOrder(order, orderbook.ErrEmptyBook.Error())
+			}
+			order.Budget = amount
+		}
+	}
+	if err != nil {
+		return ex.rejectOrder(order, fmt.Sprintf("notional of %s is too large", p.Size))
+	}
+
+	err = ex.ledger.hold(order.ID, order.UserID, asset, amount, price)
+	var insufficient *InsufficientFundsError
+	if errors.As(err, &insufficient) {
+		ex.records.finish(order.ID, StatusRejected, err.Error())
+		return &RejectedOrderError{Reason: err.Error(), Code: ErrCodeInsufficientFunds}
+	}
+
+	return err
+}
+
+func (ex *Exchange) handleGetBalances(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user ID"})
+	}
+
+	return c.JSON(http.StatusOK, GetBalancesResponse{
+		Balances: ex.ledger.balancesOf(userID),
+	})
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/stretchr/testify/assert"
+)
+
+func balanceOf(l *ledger, account int64, asset string) Balance {
+	for _, b := range l.balancesOf(account) {
+		if b.Asset == asset {
+			return b
+		}
+	}
+
+	return Balance{Asset: asset}
+}
+
+func TestLedgerPost(t *testing.T) {
+	l := newLedger()
+	assert.Nil(t, l.deposit(1, "ETH", 10 * decimal.One))
+	assert.NotNil(t, l.deposit(1, "ETH", decimal.Zero))
+
+	err := l.post(
+		entry{account: 1, asset: "ETH", amount: -decimal.One},
+		entry{account: 2, asset: "ETH", amount: 2 * decimal.One},
+	)
+	assert.NotNil(t, err)
+	assert.Equal(t, balanceOf(l, 1, "ETH").Available, 10 * decimal.One)
+	assert.Equal(t, balanceOf(l, 2, "ETH").Available, decimal.Zero)
+
+	assert.Nil(t, l.post(
+		entry{account: 1, asset: "ETH", amount: -decimal.One},
+		entry{account: 2, asset: "ETH", amount: decimal.One},
+	))
+	assert.Equal(t, balanceOf(l, 2, "ETH").Available, decimal.One)
+	assert.Nil(t, l.verify())
+
+	// A balance changed outside of a transaction breaks the invariants
+	l.balances[2]["ETH"].Available += decimal.One
+	assert.NotNil(t, l.verify())
+}
+
+func TestLedgerWithdraw(t *testing.T) {
+	l := newLedger()
+	assert.Nil(t, l.deposit(1, "ETH", 10 * decimal.One))
+	assert.Nil(t, l.hold(10, 1, "ETH", 4 * decimal.One, decimal.Zero))
+
+	// Only the available balance can be withdrawn
+	err := l.withdraw(1, "ETH", 7 * decimal.One)
+	var insufficient *InsufficientFundsError
+	assert.ErrorAs(t, err, &insufficient)
+	assert.NotNil(t, l.withdraw(1, "ETH", decimal.Zero))
+
+	assert.Nil(t, l.withdraw(1, "ETH", 6 * decimal.One))
+	assert.Equal(t, balanceOf(l, 1, "ETH"), Balance{Asset: "ETH", Locked: 4 * decimal.One})
+	assert.Equal(t, balanceOf(l, externalAccount, "ETH").Available, -4 * decimal.One)
+	assert.Nil(t, l.verify())
+
+	// What the accounts hold has to match the deposits minus the withdrawals
+	l.withdrawals["ETH"] -= decimal.One
+	assert.NotNil(t, l.verify())
+}
+
+func TestLedgerInvariantsAfterTrades(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 200; i++ {
+		userID := int64(1)
+		if r.Intn(2) == 0 {
+			userID = 8
+		}
+		size := decimal.Decimal(1 + r.Intn(50)) * decimal.Unit(1)
+		price := decimal.Decimal(990 + r.Intn(20)) * decimal.One
+
+		ex.placeOrder(limitOrder(userID, r.Intn(2) == 0, size.String(), price.String()))
+		assert.Nil(t, ex.ledger.verify())
+	}
+	assert.NotEqual(t, len(ex.orderbooks[MarketETH].Trades), 0)
+
+	// Users and the exchange together still hold exactly what was deposited
+	for asset, amount := range startingBalances {
+		total := decimal.Zero
+		for _, account := range []int64{1, 8, exchangeAccount} {
+			b := balanceOf(ex.ledger, account, asset)
+			assert.True(t, b.Available >= 0, asset)
+			total += b.Available + b.Locked
+		}
+		assert.Equal(t, total, 2 * amount, asset)
+	}
+
+	// Cancelling everything unlocks every hold
+	for _, userID := range []int64{1, 8} {
+		for _, order := range append([]*orderbook.Order{}, ex.Orders[userID]...) {
+			ex.cancelOrder(order.ID)
+		}
+		for _, b := range ex.ledger.balancesOf(userID) {
+			assert.Equal(t, b.Locked, decimal.Zero, b.Asset)
+		}
+	}
+	assert.Equal(t, len(ex.ledger.holds), 0)
+}
+
+func TestOrderHolds(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	ask := placeTestOrder(t, ex, limitOrder(1, false, "2", "1000"))
+	assert.Equal(t, balanceOf(ex.ledger, 1, "ETH").Locked, 2 * decimal.One)
+
+	bid := placeTestOrder(t, ex, limitOrder(8, true, "3", "1010"))
+	// Filled 2 at 1000 out of the 3030 held, the price improvement is
+	// released with the fill, what is left stays held at the limit price
+	assert.Equal(t, bid.SizeFilled, 2 * decimal.One)
+	assert.Equal(t, balanceOf(ex.ledger, 1, "ETH").Locked, decimal.Zero)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 1010 * decimal.One)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Available, 10_000_000 * decimal.One - 3010 * decimal.One)
+
+	record, _ := ex.records.get(ask.OrderID)
+	assert.Equal(t, record.Status, StatusFilled)
+
+	assert.True(t, ex.cancelOrder(bid.OrderID))
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, decimal.Zero)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Available, 10_000_000 * decimal.One - 2000 * decimal.One)
+
+	_, err := ex.placeOrder(limitOrder(8, true, "1000", "20000"))
+	var rejected *RejectedOrderError
+	assert.ErrorAs(t, err, &rejected)
+	assert.Equal(t, rejected.Code, ErrCodeInsufficientFunds)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, decimal.Zero)
+}
+
+func TestUnbookedTradeDoesntStopThePlacement(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	// The ETH of the first ask is gone, its trade can't be booked
+	first := placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	second := placeTestOrder(t, ex, limitOrder(9, false, "1", "1001"))
+	ex.ledger.release(first.OrderID)
+	assert.Nil(t, ex.ledger.withdraw(1, "ETH", startingBalances["ETH"]))
+
+	bid, err := ex.placeOrder(limitOrder(8, true, "2", "1001"))
+	assert.Nil(t, err)
+	assert.Equal(t, bid.SizeFilled, 2 * decimal.One)
+
+	// The trade after it is still booked and every order recorded
+	// 1001 less the maker fee
+	assert.Equal(t, balanceOf(ex.ledger, 9, "USD").Available, startingBalances["USD"] + decimal.MustParse("999.999"))
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Available, startingBalances["USD"] - 1001 * decimal.One)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, decimal.Zero)
+	for _, id := range []int64{first.OrderID, second.OrderID, bid.OrderID} {
+		record, _ := ex.records.get(id)
+		assert.Equal(t, record.Status, StatusFilled)
+	}
+	assert.Equal(t, len(ex.ledger.holds), 0)
+}
+
+func TestDebitWithinAvailable(t *testing.T) {
+	l := newLedger()
+	assert.Nil(t, l.deposit(1, "USD", 100 * decimal.One))
+	assert.Nil(t, l.hold(10, 1, "USD", 50 * decimal.One, decimal.Zero))
+
+	// 50 out of the hold and 40 out of the available balance
+	entries, fromHold, err := l.debit(10, 1, "USD", 90 * decimal.One)
+	assert.Nil(t, err)
+	assert.Equal(t, fromHold, 50 * decimal.One)
+	assert.Equal(t, len(entries), 2)
+
+	_, _, err = l.debit(10, 1, "USD", 101 * decimal.One)
+	var insufficient *InsufficientFundsError
+	assert.ErrorAs(t, err, &insufficient)
+	assert.Equal(t, insufficient.Required, 51 * decimal.One)
+
+	_, _, err = l.debit(11, 1, "USD", 51 * decimal.One)
+	assert.ErrorAs(t, err, &insufficient)
+}
+
+func TestStopMarketBidWithinReservation(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	// User 8 spends almost all of its USD, what is left covers the stop
+	placeTestOrder(t, ex, limitOrder(9, false, "1000", "9989"))
+	placeTestOrder(t, ex, limitOrder(8, true, "1000", "9989"))
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Available, 11_000 * decimal.One)
+
+	stop := placeTestOrder(t, ex, PlaceOrderRequest{
+		Type: 			StopMarketOrder,
+		Bid: 				true,
+		Size: 			10 * decimal.One,
+		StopPrice: 	1000 * decimal.One,
+		Market: 		MarketETH,
+		UserID: 		8,
+	})
+	// Reserved at its collar, 5% above the stop price
+	assert.Equal(t, balanceOf(ex.ledger, 8, "USD").Locked, 10_500 * decimal.One)
+
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	placeTestOrder(t, ex, limitOrder(1, false, "5", "1040"))
+	placeTestOrder(t, ex, limitOrder(1, false, "100", "2000"))
+	// Triggers the stop, which only fills within its collar
+	placeTestOrder(t, ex, limitOrder(9, true, "1", "1000"))
+
+	record, _ := ex.records.get(stop.OrderID)
+	assert.Equal(t, record.Status, StatusCancelled)
+	assert.Equal(t, record.FilledSize, 5 * decimal.One)
+	assert.Equal(t, record.AvgFillPrice, 1040 * decimal.One)
+
+	usd := balanceOf(ex.ledger, 8, "USD")
+	assert.Equal(t, usd.Locked, decimal.Zero)
+	assert.Equal(t, usd.Available, 11_000 * decimal.One - 5200 * decimal.One)
+	assert.Nil(t, ex.ledger.verify())
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MarketOpen 		MarketStatus = "OPEN"
+	// Orders of a halted market can be cancelled but no new order is accepted
+	MarketHalted 	MarketStatus = "HALTED"
+
+	// Optional configuration of the markets, DefaultMarkets are used without it
+	marketsConfigFile = "markets.json"
+)
+
+type (
+	MarketStatus string
+
+	// Number of decimals used for the prices and sizes of a market
+	Precision struct {
+		PriceDecimals int
+		SizeDecimals 	int
+	}
+
+	// Trading constraints every order of a market has to respect
+	MarketSpec struct {
+		Market 			Market
+		BaseAsset 	string // asset traded, sizes are in it
+		QuoteAsset 	string // asset prices are in
+		Status 			MarketStatus
+		Precision
+		TickSize 		decimal.Decimal // prices are a multiple of it
+		LotSize 		decimal.Decimal // sizes are a multiple of it
+		MinSize 		decimal.Decimal
+		MaxSize 		decimal.Decimal
+		MinNotional decimal.Decimal // minimum price * size, in the quote asset
+	}
+
+	// Markets configured at startup, in the order of the configuration
+	MarketRegistry struct {
+		markets []MarketSpec
+		byName 	map[Market]MarketSpec
+	}
+)
+
+type namedValue struct {
+	name 	string
+	value decimal.Decimal
+}
+
+var DefaultMarkets = []MarketSpec{
+	{
+		Market: 		 MarketETH,
+		BaseAsset: 	 "ETH",
+		QuoteAsset:  "USD",
+		Status: 		 MarketOpen,
+		Precision: 	 Precision{PriceDecimals: 2, SizeDecimals: 4},
+		TickSize: 	 decimal.MustParse("0.01"),
+		LotSize: 		 decimal.MustParse("0.0001"),
+		MinSize: 		 decimal.MustParse("0.0001"),
+		MaxSize: 		 1_000 * decimal.One,
+		MinNotional: decimal.One,
+	},
+}
+
+// LoadMarkets reads the markets from a JSON list of MarketSpec,
+// DefaultMarkets are returned when the file doesn't exist
+func LoadMarkets(path string) ([]MarketSpec, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultMarkets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var markets []MarketSpec
+	if err := json.Unmarshal(data, &markets); err != nil {
+		return nil, fmt.Errorf("invalid markets configuration %s: %w", path, err)
+	}
+
+	return markets, nil
+}
+
+func NewMarketRegistry(markets []MarketSpec) (*MarketRegistry, error) {
+	if len(markets) == 0 {
+		return nil, fmt.Errorf("no market configured")
+	}
+
+	r := &MarketRegistry{
+		byName: make(map[Market]MarketSpec),
+	}
+
+	for _, spec := range markets {
+		if spec.Status == "" {
+			spec.Status = MarketOpen
+		}
+		if err := validateSpec(spec); err != nil {
+			return nil, fmt.Errorf("market %s: %w", spec.Market, err)
+		}
+		if _, ok := r.byName[spec.Market]; ok {
+			return nil, fmt.Errorf("market %s is configured twice", spec.Market)
+		}
+
+		r.markets = append(r.markets, spec)
+		r.byName[spec.Market] = spec
+	}
+
+	return r, nil
+}
+
+func validateSpec(spec MarketSpec) error {
+	if spec.Market == "" || spec.BaseAsset == "" || spec.QuoteAsset == "" {
+		return fmt.Errorf("market, base asset and quote asset are required")
+	}
+	if spec.Status != MarketOpen && spec.Status != MarketHalted {
+		return fmt.Errorf("invalid status %s", spec.Status)
+	}
+	if spec.TickSize <= 0 || !spec.TickSize.IsMultipleOf(decimal.Unit(spec.PriceDecimals)) {
+		return fmt.Errorf("tick size %s doesn't fit %d price decimals", spec.TickSize, spec.PriceDecimals)
+	}
+	if spec.LotSize <= 0 || !spec.LotSize.IsMultipleOf(decimal.Unit(spec.SizeDecimals)) {
+		return fmt.Errorf("lot size %s doesn't fit %d size decimals", spec.LotSize, spec.SizeDecimals)
+	}
+	if spec.MaxSize < spec.MinSize {
+		return fmt.Errorf("max size %s is below min size %s", spec.MaxSize, spec.MinSize)
+	}
+
+	return nil
+}
+
+func (r *MarketRegistry) Get(market Market) (MarketSpec, bool) {
+	spec, ok := r.byName[market]
+	return spec, ok
+}
+
+func (r *MarketRegistry) All() []MarketSpec {
+	return append([]MarketSpec{}, r.markets...)
+}
+
+func (ex *Exchange) handleGetMarkets(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.markets.All())
+}
+
+func (ex *Exchange) handleGetMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+	spec, ok := ex.markets.Get(market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	return c.JSON(http.StatusOK, spec)
+}
+
+// validateMarketSpec checks the prices and sizes of an order against the
+// tick size, lot size and size / notional limits of its market
+func (ex *Exchange) validateMarketSpec(spec MarketSpec, p PlaceOrderRequest) error {
+	if (p.Type == LimitOrder || p.Type == StopLimitOrder) && p.Price <= 0 {
+		return fmt.Errorf("limit price must be positive")
+	}
+
+	prices := []namedValue{
+		{"price", p.Price},
+		{"stop price", p.StopPrice},
+		{"worst price", p.WorstPrice},
+	}
+	for _, price := range prices {
+		if !price.value.IsMultipleOf(spec.TickSize) {
+			return fmt.Errorf("%s %s is not a multiple of the tick size %s", price.name, price.value, spec.TickSize)
+		}
+	}
+
+	sizes := []namedValue{
+		{"size", p.Size},
+		{"display size", p.DisplaySize},
+	}
+	for _, size := range sizes {
+		if !size.value.IsMultipleOf(spec.LotSize) {
+			return fmt.Errorf("%s %s is not a multiple of the lot size %s", size.name, size.value, spec.LotSize)
+		}
+	}
+
+	if p.Size < spec.MinSize {
+		return fmt.Errorf("size %s is below the minimum size %s", p.Size, spec.MinSize)
+	}
+	if p.Size > spec.MaxSize {
+		return fmt.Errorf("size %s is above the maximum size %s", p.Size, spec.MaxSize)
+	}
+
+	price := ex.notionalPrice(spec.Market, p)
+	notional, err := price.CheckedMul(p.Size)
+	if err != nil {
+		return fmt.Errorf("notional of %s at %s is too large", p.Size, price)
+	}
+	// Only a market order on an empty book has no price to check, it is
+	// rejected once placed anyway
+	if (price != 0 || p.Type != MarketOrder) && notional < spec.MinNotional {
+		return fmt.Errorf("notional %s is below the minimum notional %s", notional, spec.MinNotional)
+	}
+
+	return nil
+}
+
+// notionalPrice is the price used to estimate the notional of an order,
+// market orders are estimated against the opposite touch
+func (ex *Exchange) notionalPrice(market Market, p PlaceOrderRequest) decimal.Decimal {
+	switch p.Type {
+	case LimitOrder, StopLimitOrder:
+		return p.Price
+	case StopMarketOrder:
+		return p.StopPrice
+	}
+
+	// Read once under the book lock, a match may clear the touch at any time
+	price, _ := ex.orderbooks[market].BestPrice(!p.Bid)
+
+	return price
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMarketSpec(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+	spec := DefaultMarkets[0]
+
+	marketOrder := func(bid bool, size string) PlaceOrderRequest {
+		return PlaceOrderRequest{Type: MarketOrder, Bid: bid, Size: decimal.MustParse(size), Market: MarketETH}
+	}
+	stopOrder := func(typ OrderType, size, stopPrice, price string) PlaceOrderRequest {
+		p := limitOrder(8, true, size, price)
+		p.Type = typ
+		p.StopPrice = decimal.MustParse(stopPrice)
+		return p
+	}
+	withDisplay := limitOrder(8, true, "1", "1000")
+	withDisplay.DisplaySize = decimal.MustParse("0.00005")
+	withWorst := marketOrder(true, "1")
+	withWorst.WorstPrice = decimal.MustParse("1000.005")
+
+	tests := []struct {
+		name 	string
+		p 		PlaceOrderRequest
+		err 	string
+	}{
+		{"valid limit", limitOrder(8, true, "1", "1000"), ""},
+		{"zero price", limitOrder(8, true, "1", "0"), "limit price must be positive"},
+		{"negative price", limitOrder(8, false, "1", "-1000"), "limit price must be positive"},
+		{"zero stop-limit price", stopOrder(StopLimitOrder, "1", "1000", "0"), "limit price must be positive"},
+		{"price off tick", limitOrder(8, true, "1", "1000.005"), "price 1000.005 is not a multiple of the tick size 0.01"},
+		{"worst price off tick", withWorst, "worst price 1000.005 is not a multiple of the tick size 0.01"},
+		{"size off lot", limitOrder(8, true, "1.00005", "1000"), "size 1.00005 is not a multiple of the lot size 0.0001"},
+		{"display size off lot", withDisplay, "display size 0.00005 is not a multiple of the lot size 0.0001"},
+		{"size above max", limitOrder(8, true, "1000.0001", "1000"), "size 1000.0001 is above the maximum size 1000"},
+		{"notional below min", limitOrder(8, true, "0.0009", "1000"), "notional 0.9 is below the minimum notional 1"},
+		{"notional too large", limitOrder(8, true, "1000", "100000000"), "notional of 1000 at 100000000 is too large"},
+		{"stop-market notional below min", stopOrder(StopMarketOrder, "0.0009", "1000", "0"), "notional 0.9 is below the minimum notional 1"},
+		{"market order on an empty book", marketOrder(true, "0.0001"), ""},
+	}
+	for _, test := range tests {
+		err := ex.validateMarketSpec(spec, test.p)
+		if test.err == "" {
+			assert.Nil(t, err, test.name)
+		} else if assert.NotNil(t, err, test.name) {
+			assert.Equal(t, err.Error(), test.err, test.name)
+		}
+	}
+
+	spec.MinSize = decimal.MustParse("0.01")
+	err := ex.validateMarketSpec(spec, limitOrder(8, true, "0.001", "1000"))
+	assert.Equal(t, err.Error(), "size 0.001 is below the minimum size 0.01")
+
+	// Market orders are checked against the touch once there is one
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	err = ex.validateMarketSpec(DefaultMarkets[0], marketOrder(true, "0.0009"))
+	assert.Equal(t, err.Error(), "notional 0.9 is below the minimum notional 1")
+	assert.Nil(t, ex.validateMarketSpec(DefaultMarkets[0], marketOrder(true, "0.001")))
+}
+
+func TestZeroPriceOrdersRejected(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	_, err := ex.placeOrder(limitOrder(1, true, "1", "0"))
+	var rejected *RejectedOrderError
+	assert.ErrorAs(t, err, &rejected)
+	_, err = ex.placeOrder(limitOrder(8, false, "1", "0"))
+	assert.ErrorAs(t, err, &rejected)
+
+	assert.Equal(t, len(ex.orderbooks[MarketETH].Trades), 0)
+	assert.Equal(t, balanceOf(ex.ledger, 8, "ETH").Available, startingBalances["ETH"])
+}
+
+func TestHandleGetMarket(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	get := func(market string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/markets/"+market, nil), rec)
+		c.SetParamNames("market")
+		c.SetParamValues(market)
+		assert.Nil(t, ex.handleGetMarket(c))
+		return rec
+	}
+
+	rec := get("ETH")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	var spec MarketSpec
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &spec))
+	assert.Equal(t, spec, DefaultMarkets[0])
+
+	assert.Equal(t, get("BTC").Code, http.StatusBadRequest)
+}
+
+func TestNewMarketRegistry(t *testing.T) {
+	btc := DefaultMarkets[0]
+	btc.Market, btc.BaseAsset, btc.Status = "BTC", "BTC", ""
+
+	r, err := NewMarketRegistry([]MarketSpec{btc, DefaultMarkets[0]})
+	assert.Nil(t, err)
+	markets := r.All()
+	assert.Equal(t, markets[0].Market, Market("BTC"))
+	assert.Equal(t, markets[1], DefaultMarkets[0])
+	// The status defaults to open
+	spec, ok := r.Get("BTC")
+	assert.True(t, ok)
+	assert.Equal(t, spec.Status, MarketOpen)
+	_, ok = r.Get("SOL")
+	assert.False(t, ok)
+
+	invalid := func(change func(spec *MarketSpec)) MarketSpec {
+		spec := DefaultMarkets[0]
+		change(&spec)
+		return spec
+	}
+	tests := []struct {
+		name 		string
+		markets []MarketSpec
+	}{
+		{"no market", []MarketSpec{}},
+		{"configured twice", []MarketSpec{DefaultMarkets[0], DefaultMarkets[0]}},
+		{"no quote asset", []MarketSpec{invalid(func(s *MarketSpec) { s.QuoteAsset = "" })}},
+		{"invalid status", []MarketSpec{invalid(func(s *MarketSpec) { s.Status = "CLOSED" })}},
+		{"tick size too precise", []MarketSpec{invalid(func(s *MarketSpec) { s.TickSize = decimal.MustParse("0.001") })}},
+		{"no lot size", []MarketSpec{invalid(func(s *MarketSpec) { s.LotSize = decimal.Zero })}},
+		{"max size below min size", []MarketSpec{invalid(func(s *MarketSpec) { s.MaxSize = decimal.Unit(5) })}},
+	}
+	for _, test := range tests {
+		_, err := NewMarketRegistry(test.markets)
+		assert.NotNil(t, err, test.name)
+	}
+}
+
+func TestLoadMarkets(t *testing.T) {
+	dir := t.TempDir()
+
+	// Without configuration
+	markets, err := LoadMarkets(filepath.Join(dir, marketsConfigFile))
+	assert.Nil(t, err)
+	assert.Equal(t, markets, DefaultMarkets)
+
+	btc := DefaultMarkets[0]
+	btc.Market, btc.BaseAsset, btc.Status = "BTC", "BTC", MarketHalted
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(path, data, 0644))
+		return path
+	}
+	encode := func(markets ...MarketSpec) []byte {
+		data, err := json.Marshal(markets)
+		assert.Nil(t, err)
+		return data
+	}
+
+	markets, err = LoadMarkets(write("markets.json", encode(DefaultMarkets[0], btc)))
+	assert.Nil(t, err)
+	assert.Equal(t, markets, []MarketSpec{DefaultMarkets[0], btc})
+
+	_, err = LoadMarkets(write("invalid.json", []byte(`[{"Market": "ETH", "TickSize": "0.0.1"}]`)))
+	assert.NotNil(t, err)
+
+	// Loaded as is, the registry refuses them
+	markets, err = LoadMarkets(write("twice.json", encode(btc, btc)))
+	assert.Nil(t, err)
+	_, err = NewExchange(exchangePrivKey, dir, internalSettlement{}, markets, DefaultFeeSchedule)
+	assert.NotNil(t, err)
+}
+
+func TestHandleGetMarkets(t *testing.T) {
+	ex := newTwoMarketExchange(t)
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/markets", nil), rec)
+	assert.Nil(t, ex.handleGetMarkets(c))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	var markets []MarketSpec
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &markets))
+	assert.Equal(t, markets, ex.markets.All())
+	assert.Equal(t, markets[1].Market, Market("BTC"))
+}
+
+func TestHaltedMarket(t *testing.T) {
+	ex := newTwoMarketExchange(t)
+	resting := placeTestOrder(t, ex, btcOrder(8, true, "1", "20000"))
+
+	spec, _ := ex.markets.Get("BTC")
+	spec.Status = MarketHalted
+	ex.markets.byName["BTC"] = spec
+
+	_, err := ex.placeOrder(btcOrder(1, false, "1", "20000"))
+	var rejected *RejectedOrderError
+	assert.ErrorAs(t, err, &rejected)
+	assert.Equal(t, rejected.Reason, "market BTC is HALTED")
+	assert.Equal(t, len(ex.orderbooks["BTC"].Trades), 0)
+
+	assert.Equal(t, amendTestOrder(t, ex, resting.OrderID, "21000", "0").Code, http.StatusBadRequest)
+
+	// The other markets trade on, orders of the halted one can still be cancelled
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	placeTestOrder(t, ex, limitOrder(8, true, "1", "1000"))
+	assert.Equal(t, len(ex.orderbooks[MarketETH].Trades), 1)
+
+	assert.True(t, ex.cancelOrder(resting.OrderID))
+	assertNothingLocked(t, ex, 8)
+}
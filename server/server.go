@@ -1,23 +1,23 @@
 package server
 
 import (
-	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/big"
+	"path/filepath"
 	"sync"
 
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
 	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 
@@ -28,12 +28,34 @@ const (
 	// Dummy anvil priv key
 	exchangePrivKey = "ac0974bec39a17e36ba4a6b4d238ff944bacb478cbed5efcae784d7bf4f2ff80"
 
+	// How often the GTD orders are checked for expiry
+	expirySweepInterval = 1 * time.Second
+
 	MarketOrder OrderType = "MARKET"
 	LimitOrder 	OrderType = "LIMIT"
+	// Stop orders wait in the trigger book until a trade prints at or through StopPrice
+	StopMarketOrder OrderType = "STOP_MARKET"
+	StopLimitOrder 	OrderType = "STOP_LIMIT"
 
 	MarketETH Market = "ETH"
+
+	// Base units of ETH used when settling on chain (wei)
+	ethDecimals = 18
+
+	maxClientOrderIDLength = 64
+
+	// Collar of the stop-market bids without one, their funds are reserved at it
+	defaultStopSlippageBps = 500
+
+	// Directory of the files which outlive a restart of the exchange
+	defaultDataDir = "data"
+
+	// Where the order and trade ID sequences are persisted across restarts, in the data directory
+	orderIDsFile = "order_ids"
+	tradeIDsFile = "trade_ids"
 )
 
+
 type (
 	OrderType string
 	Market string
@@ -41,41 +63,78 @@ type (
 	PlaceOrderRequest struct {
 		Type 		OrderType // Limit or market
 		Bid 		bool
-		Size 		float64
-		Price 	float64
+		Size 		decimal.Decimal
+		Price 	decimal.Decimal
 		Market 	Market
 		UserID 	int64
+		// Defaults to GTC for limit orders, market orders are FOK by default
+		// and IOC fills the available volume and cancels the rest
+		TimeInForce orderbook.TimeInForce
+		// Expiry of a GTD order as a unix nano timestamp
+		ExpiresAt 	int64
+		// Post-only limit orders are rejected if they would take liquidity,
+		// unless PostOnlyReprice is set and they get moved one tick away from the touch
+		PostOnly 				bool
+		PostOnlyReprice bool
+		// Trigger price of STOP_MARKET and STOP_LIMIT orders, Price is the limit of a STOP_LIMIT
+		StopPrice 			decimal.Decimal
+		// Iceberg limit orders only show DisplaySize of their Size in the book
+		DisplaySize 		decimal.Decimal
+		// Slippage protection of market orders, either the worst acceptable price
+		// or a maximum distance from the touch in basis points. For stop-market
+		// orders the distance is from the stop price, stop-market bids are
+		// collared defaultStopSlippageBps away from it by default.
+		WorstPrice 			decimal.Decimal
+		MaxSlippageBps 	int64
+		// What to do instead of matching another order of the same user,
+		// defaults to the setting of the account
+		SelfTradePrevention orderbook.SelfTradePrevention
+		// Optional ID given by the user, unique among the orders of the user.
+		// Submitting it again returns the result of the first submission.
+		ClientOrderID string
 	}
 
 	Order struct {
 		UserID 		int64
 		ID 				int64
-		Price 		float64
-		Size 			float64
+		Price 		decimal.Decimal
+		Size 			decimal.Decimal
 		Bid 			bool
 		Timestamp int64
+		StopPrice decimal.Decimal `json:",omitempty"`
+		// Iceberg reserve, only shown to the owner of the order
+		HiddenSize decimal.Decimal `json:",omitempty"`
 	}
 
 	OrderbookData struct {
-		TotalBidVolume 	float64
-		TotalAskVolume	float64
+		TotalBidVolume 	decimal.Decimal
+		TotalAskVolume	decimal.Decimal
 		Asks 						[]*Order
 		Bids 						[]*Order
 	}
 
 	Exchange struct {
-		Client 					*ethclient.Client
+		settlement 			Settlement
 		mu 							sync.RWMutex
 		PrivateKey 			*ecdsa.PrivateKey // Exchange hot wallet
 		orderbooks			map[Market]*orderbook.Orderbook
+		markets 				*MarketRegistry
 		Orders 					map[int64][]*orderbook.Order // map users to his orders
 		Users 					map[int64]*User
+		orderIDs 				*orderbook.IDGenerator
+		tradeIDs 				*orderbook.IDGenerator
+		fills 					*fillIndex
+		records 				*orderRecords
+		settings 				map[int64]UserSettings
+		ledger 					*ledger
+		fees 						*feeTracker
+		settlements 		*settlementQueue
 	}
 
 	MatchedOrder struct {
 		UserID 		int64
-		Size 			float64
-		Price 		float64
+		Size 			decimal.Decimal
+		Price 		decimal.Decimal
 		ID 				int64
 	}
 
@@ -86,6 +145,8 @@ type (
 
 	APIError struct {
 		Error string
+		// Machine readable reason, only set for some errors
+		Code 	string `json:",omitempty"`
 	}
 )
 
@@ -95,39 +156,87 @@ func StartServer() {
 
 	e.HTTPErrorHandler = httpErrorHandler
 
-	// RPC address -- in this case anvil
-	client, err := ethclient.Dial("http://localhost:8545")
+	// Demo users, by ID
+	userKeys := map[int64]string{
+		9: "2a871d0798f97d79848a013d4936a73bf4cc922c825d33c1cf7073dff6d409c6",
+		8: "dbda1821b80551c9d65939329250298aa3472ba22feea921c0cf5d620ea67b97",
+		1: "59c6995e998f97a5a0044966f0945389dc9e86dae88c7a8412f4603b6b78690d",
+	}
+
+	settlementConfig, err := LoadSettlementConfig(settlementConfigFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Wallets of the exchange and of the users
+	wallets := []common.Address{}
+	keys := []string{exchangePrivKey}
+	for _, pk := range userKeys {
+		keys = append(keys, pk)
+	}
+	for _, pk := range keys {
+		key, err := crypto.HexToECDSA(pk)
+		if err != nil {
+			log.Fatal(err)
+		}
+		wallets = append(wallets, crypto.PubkeyToAddress(key.PublicKey))
+	}
+
+	settlement, err := NewSettlement(settlementConfig, wallets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	markets, err := LoadMarkets(marketsConfigFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	feeSchedule, err := LoadFeeSchedule(feesConfigFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ex, err := NewExchange(exchangePrivKey, client)
+	ex, err := NewExchange(exchangePrivKey, defaultDataDir, settlement, markets, feeSchedule)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Add a user 9
-	pk9 := "2a871d0798f97d79848a013d4936a73bf4cc922c825d33c1cf7073dff6d409c6"
-	// Add a user 8
-	pk8 := "dbda1821b80551c9d65939329250298aa3472ba22feea921c0cf5d620ea67b97"
-	// Add 1
-	pk1 := "59c6995e998f97a5a0044966f0945389dc9e86dae88c7a8412f4603b6b78690d"
-	ex.registerUser(pk8, 8)
-	ex.registerUser(pk9, 9)
-	ex.registerUser(pk1, 1)
-	// address1 := "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
-	// balance1, err := client.BalanceAt(context.Background(), common.HexToAddress(address1), nil)
-	// fmt.Printf("User 1- starting balance: %s\n", balance1)
+	for userID, pk := range userKeys {
+		ex.registerUser(pk, userID)
+		ex.fund(userID, startingBalances)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"backend": settlementConfig.Backend,
+	}).Info("Settlement configured")
 
 	e.POST("/order", ex.handlePlaceOrder)
+	e.POST("/orders/batch", ex.handlePlaceOrders)
 
 	e.GET("/trades/:market", ex.HandleGetTrades)
 	e.GET("/order/:userID", ex.handleGetOrders)
+	e.GET("/order/status/:id", ex.handleGetOrder)
 	e.GET("/book/:market", ex.handleGetBook)
 	e.GET("/book/:market/bestbid", ex.handleGetBestBid)
 	e.GET("/book/:market/bestask", ex.handleGetBestAsk)
-
+	e.GET("/markets", ex.handleGetMarkets)
+	e.GET("/markets/:market", ex.handleGetMarket)
+	e.GET("/fills/:userID", ex.handleGetFills)
+	e.GET("/balances/:userID", ex.handleGetBalances)
+	e.GET("/settlements/:tradeID", ex.handleGetSettlement)
+	e.GET("/users/:userID/settings", ex.handleGetUserSettings)
+	e.PUT("/users/:userID/settings", ex.handlePutUserSettings)
+	e.GET("/users/:userID/orders/:clientOrderID", ex.handleGetOrderByClientID)
+	e.DELETE("/users/:userID/orders/:clientOrderID", ex.handleCancelOrderByClientID)
+
+	e.PUT("/order/:id", ex.handleAmendOrder)
 	e.DELETE("/order/:id", ex.handleCancelOrder)
+	e.DELETE("/orders", ex.handleCancelOrders)
+
+	go ex.sweepExpiredOrders(expirySweepInterval)
+	go ex.runSettlements(settlementInterval)
+	go ex.auditLedger(ledgerAuditInterval)
 
 	e.Start(":4000")
 }
@@ -157,28 +266,79 @@ func NewUser(privateKey string, id int64) *User {
 	}
 }
 
-func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error) {
+// NewExchange creates an exchange keeping its ID sequences and settlement
+// journal in dataDir
+func NewExchange(privateKey string, dataDir string, settlement Settlement, markets []MarketSpec, feeSchedule FeeSchedule) (*Exchange, error) {
+	registry, err := NewMarketRegistry(markets)
+	if err != nil {
+		return nil, err
+	}
+
+	fees, err := newFeeTracker(feeSchedule)
+	if err != nil {
+		return nil, err
+	}
+
+	settlements, err := newSettlementQueue(filepath.Join(dataDir, settlementsFile))
+	if err != nil {
+		return nil, err
+	}
+
+	orderIDs, err := orderbook.NewIDGenerator(filepath.Join(dataDir, orderIDsFile))
+	if err != nil {
+		return nil, err
+	}
+	tradeIDs, err := orderbook.NewIDGenerator(filepath.Join(dataDir, tradeIDsFile))
+	if err != nil {
+		return nil, err
+	}
+
 	orderbooks := make(map[Market]*orderbook.Orderbook)
-	orderbooks[MarketETH] = orderbook.NewOrderbook()
+	for _, spec := range registry.All() {
+		ob := orderbook.NewOrderbook()
+		ob.TickSize = spec.TickSize
+		ob.LotSize = spec.LotSize
+		ob.Market = string(spec.Market)
+		// Trade IDs are unique across all the markets of the exchange
+		ob.TradeIDs = tradeIDs
+
+		orderbooks[spec.Market] = ob
+	}
 
 	privKey, err := crypto.HexToECDSA(privateKey)
 	if err != nil {
 		return nil, err
 	}
 
+	ledger := newLedger()
+	records := newOrderRecords()
+	// Orders which are done no longer need their funds
+	records.onTerminal = ledger.release
+
 	return &Exchange{
-		Client: 			client,
+		settlement: 	settlement,
 		PrivateKey: 	privKey,
 		orderbooks: 	orderbooks,
+		markets: 			registry,
 		Users: 				make(map[int64]*User),
 		Orders: 			make(map[int64][]*orderbook.Order),
 		mu: 					sync.RWMutex{},
+		orderIDs: 		orderIDs,
+		tradeIDs: 		tradeIDs,
+		fills: 				newFillIndex(),
+		records: 			records,
+		settings: 		make(map[int64]UserSettings),
+		ledger: 			ledger,
+		fees: 				fees,
+		settlements: 	settlements,
 	}, nil
 }
 
 type GetOrdersResponse struct {
 	Asks []Order
 	Bids []Order
+	// Stop orders waiting for their trigger price
+	Stops []Order
 }
 
 
@@ -214,10 +374,24 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 	orderResp := &GetOrdersResponse{
 		Asks: []Order{},
 		Bids: []Order{},
+		Stops: []Order{},
 	}
 
 
 	for i := 0; i < len(orderbookOrders); i++ {
+		if stop, ok := ex.pendingStop(orderbookOrders[i].ID); ok {
+			orderResp.Stops = append(orderResp.Stops, Order{
+				ID:    			stop.Order.ID,
+				UserID: 		stop.Order.UserID,
+				Price:     	stop.LimitPrice,
+				StopPrice: 	stop.StopPrice,
+				Size:      	stop.Order.Size,
+				Timestamp: 	stop.Order.Timestamp,
+				Bid:       	stop.Order.Bid,
+			})
+			continue
+		}
+
 		// it could be that the order is getting filled even though it is included in this response
 		// We need to double check if the Limit is not nil
 		if orderbookOrders[i].Limit == nil {
@@ -228,6 +402,7 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 			UserID: 		orderbookOrders[i].UserID,
 			Price:     	orderbookOrders[i].Limit.Price,
 			Size:      	orderbookOrders[i].Size,
+			HiddenSize: orderbookOrders[i].HiddenSize,
 			Timestamp: 	orderbookOrders[i].Timestamp,
 			Bid:       	orderbookOrders[i].Bid,
 		}
@@ -252,14 +427,15 @@ func (ex *Exchange) handleGetBook(c echo.Context) error {
 	}
 
 	orderbookData := OrderbookData{
-		TotalBidVolume: 	ob.BidTotalVolume(),
-		TotalAskVolume: 	ob.AskTotalVolume(),
+		// Iceberg reserves are not shown, only their display slice
+		TotalBidVolume: 	ob.BidDisplayVolume(),
+		TotalAskVolume: 	ob.AskDisplayVolume(),
 		Asks: 						[]*Order{},
 		Bids: 						[]*Order{},
 	}
 
 	for _, limit := range ob.Asks() {
-		for _, order := range limit.Orders {
+		for _, order := range limit.Orders() {
 			o := Order{
 				UserID: 		order.UserID,
 				ID: 				order.ID,
@@ -273,7 +449,7 @@ func (ex *Exchange) handleGetBook(c echo.Context) error {
 	}
 
 	for _, limit := range ob.Bids() {
-		for _, order := range limit.Orders {
+		for _, order := range limit.Orders() {
 			o := Order{
 				UserID: 		order.UserID,
 				ID: 				order.ID,
@@ -291,21 +467,23 @@ func (ex *Exchange) handleGetBook(c echo.Context) error {
 
 
 type PriceResponse struct {
-	Price float64
+	Price decimal.Decimal
 }
 
 func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob := ex.orderbooks[market]
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
+	}
 
-	if len(ob.Bids()) == 0 {
+	price, ok := ob.BestPrice(true)
+	if !ok {
 		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "no bids available"})
 	}
 
-	bestBidPrice := ob.Bids()[0].Price // They are already sorted so we know this is the best
-
 	pr := &PriceResponse{
-		Price: bestBidPrice,
+		Price: price,
 	}
 
 	return c.JSON(http.StatusOK, pr)
@@ -313,16 +491,18 @@ func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 
 func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob := ex.orderbooks[market]
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
+	}
 
-	if len(ob.Asks()) == 0 {
+	price, ok := ob.BestPrice(false)
+	if !ok {
 		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "no asks available"})
 	}
 
-	bestAskResponse := ob.Asks()[0].Price // They are already sorted so we know this is the best
-
 	pr := &PriceResponse{
-		Price: bestAskResponse,
+		Price: price,
 	}
 
 	return c.JSON(http.StatusOK, pr)
@@ -335,24 +515,206 @@ func (ex *Exchange) handleCancelOrder(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "invalid id"})
 	}
 
-	ob := ex.orderbooks[MarketETH] // Get rid of hardcoding
-	order := ob.Orders[id]
-	ob.CancelOrder(order)
-
-	log.Println("order cancelled => id: ", id)
+	if !ex.cancelOrder(id) {
+		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "order not found"})
+	}
 
 	return c.JSON(http.StatusOK, map[string]any{"msg": "order cancelled", "id": id})
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder) {
+// cancelOrder cancels a resting or pending stop order in whichever market it is
+func (ex *Exchange) cancelOrder(id int64) bool {
+	for _, ob := range ex.orderbooks {
+		order, ok := ob.Cancel(id)
+		if !ok {
+			continue
+		}
+
+		ex.removeOrders([]*orderbook.Order{order})
+		ex.records.finish(id, StatusCancelled, "")
+
+		log.Println("order cancelled => id: ", id)
+
+		return true
+	}
+
+	return false
+}
+
+type CancelOrdersResponse struct {
+	OrderIDs []int64
+}
+
+// handleCancelOrders cancels every order of a user, optionally only the
+// ones of a market and / or a side (BID or ASK) given in the query
+func (ex *Exchange) handleCancelOrders(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.QueryParam("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user ID"})
+	}
+
+	market := Market(c.QueryParam("market"))
+	if _, ok := ex.orderbooks[market]; market != "" && !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	side := c.QueryParam("side")
+	if side != "" && side != "BID" && side != "ASK" {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "side must be BID or ASK"})
+	}
+
+	resp := &CancelOrdersResponse{
+		OrderIDs: []int64{},
+	}
+
+	// Every book is locked at once, in the order of the configuration, so
+	// that no order of the user can trade while the others are cancelled
+	books := []*orderbook.Orderbook{}
+	for _, spec := range ex.markets.All() {
+		if market == "" || spec.Market == market {
+			books = append(books, ex.orderbooks[spec.Market])
+		}
+	}
+
+	cancelled := orderbook.CancelOrdersIn(books, func(o *orderbook.Order) bool {
+		return o.UserID == userID && (side == "" || o.Type() == side)
+	})
+	ex.removeOrders(cancelled)
+
+	for _, order := range cancelled {
+		ex.records.finish(order.ID, StatusCancelled, "")
+		resp.OrderIDs = append(resp.OrderIDs, order.ID)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"market": market,
+		"side": 	side,
+		"count": 	len(resp.OrderIDs),
+	}).Info("Cancelled orders")
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Price and remaining size of an amended order, a zero value keeps the current one
+type AmendOrderRequest struct {
+	Price decimal.Decimal
+	Size 	decimal.Decimal
+}
+
+func (ex *Exchange) handleAmendOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid id"})
+	}
+
+	var amendData AmendOrderRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&amendData); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request"})
+	}
+	if amendData.Price < 0 || amendData.Size < 0 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "price and size must be positive"})
+	}
+
+	record, ok := ex.records.get(id)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "order not found"})
+	}
+
+	ob := ex.orderbooks[record.Market]
+	order, ok := ob.Order(id)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: orderbook.ErrOrderNotResting.Error()})
+	}
+
+	spec, _ := ex.markets.Get(record.Market)
+	if spec.Status != MarketOpen {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("market %s is %s", spec.Market, spec.Status)})
+	}
+
+	// The price and size it keeps are only known under the book lock, the
+	// order could be filled in between. A limit order is validated without
+	// reading the book, so it is checked under its lock
+	var price, size decimal.Decimal
+	var held hold
+	resized := false
+	check := func(p, s decimal.Decimal) error {
+		price, size = p, s
+		if err := ex.validateMarketSpec(spec, PlaceOrderRequest{
+			Type: 	LimitOrder,
+			Bid: 		order.Bid,
+			Market: record.Market,
+			Price: 	price,
+			Size: 	size,
+		}); err != nil {
+			return rejectRequest(err.Error())
+		}
+
+		required, limitPrice := size, decimal.Zero
+		if order.Bid {
+			required, limitPrice = size.Mul(price), price
+		}
+		var err error
+		if held, err = ex.ledger.resize(id, required, limitPrice); err != nil {
+			var insufficient *InsufficientFundsError
+			if errors.As(err, &insufficient) {
+				return &RejectedOrderError{Reason: err.Error(), Code: ErrCodeInsufficientFunds}
+			}
+			return err
+		}
+		resized = true
+
+		return nil
+	}
+
+	fromPrevented := len(order.PreventedMatches)
+	fromReleased := len(order.ReleasedStops)
+	matches, err := ob.AmendOrder(order, amendData.Price, amendData.Size, check)
+	if err != nil && resized {
+		if _, err := ex.ledger.resize(id, held.amount, held.price); err != nil {
+			logrus.WithError(err).Error("Failed to restore the hold of an order")
+		}
+	}
+	var rejected *RejectedOrderError
+	if errors.As(err, &rejected) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: rejected.Reason, Code: rejected.Code})
+	}
+	if errors.Is(err, orderbook.ErrPostOnlyWouldCross) || errors.Is(err, orderbook.ErrOrderNotResting) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{"msg": "error amending order"})
+	}
+
+	if len(matches) > 0 {
+		ex.pruneFilledOrders()
+	}
+
+	// Amended before the fills are applied, so that they add up to the new size
+	ex.records.amend(id, price, size)
+	fees := ex.recordPlacement(order, matches, order.PreventedMatches[fromPrevented:], order.ReleasedStops[fromReleased:])
+
+	logrus.WithFields(logrus.Fields{
+		"id": 		id,
+		"price": 	price,
+		"size": 	size,
+	}).Info("Amended order")
+
+	return c.JSON(http.StatusOK, newPlaceOrderResponse(order, matches, fees))
+}
+
+func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder, error) {
 	ob := ex.orderbooks[market]
-	matches := ob.PlaceMarketOrder(order)
+	matches, err := ob.PlaceMarketOrder(order)
+	if err != nil {
+		return nil, nil, err
+	}
 	matchesOrders := make([]*MatchedOrder, len(matches))
 
 	isBid := order.Bid
 
-	totalSizeFilled := 0.0
-	sumPrice := 0.0
+	totalSizeFilled := decimal.Zero
+	sumPrice := decimal.Zero
 	for i := 0 ; i < len(matches); i++ {
 		var (
 			match = matches[i]
@@ -376,7 +738,10 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		sumPrice += match.Price
 	}
 
-	avgPrice := sumPrice / float64(len(matches))
+	avgPrice := decimal.Zero
+	if len(matches) > 0 {
+		avgPrice = sumPrice / decimal.Decimal(len(matches))
+	}
 
 	logrus.WithFields(logrus.Fields{
 		"type": 		order.Type(),
@@ -384,6 +749,13 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		"avgPrice": avgPrice,
 	}).Info("Filled market order")
 
+	ex.pruneFilledOrders()
+
+	return matches, matchesOrders, nil
+}
+
+// pruneFilledOrders drops the orders that got filled from the users' open orders
+func (ex *Exchange) pruneFilledOrders() {
 	newOrderMap := make(map[int64][]*orderbook.Order)
 
 	ex.mu.Lock()
@@ -399,26 +771,101 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 
 	ex.Orders = newOrderMap
 	ex.mu.Unlock()
-
-	return matches, matchesOrders
 }
 
-func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error {
+func (ex *Exchange) handlePlaceLimitOrder(market Market, price decimal.Decimal, order *orderbook.Order) ([]orderbook.Match, error) {
 	ob := ex.orderbooks[market]
-	ob.PlaceLimitOrder(price, order)
+	matches, err := ob.PlaceLimitOrder(price, order)
+	if err != nil {
+		return nil, err
+	}
 
-	// Keep track of the user's orders
+	if len(matches) > 0 {
+		ex.pruneFilledOrders()
+	}
+
+	// Keep track of the user's orders, only if some of it rests in the book
+	// IOC / FOK leftovers are already cancelled at this point
+	if order.Limit != nil {
+		ex.mu.Lock()
+		ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+		ex.mu.Unlock()
+	}
+
+	// log.Printf("new LIMIT order => type: [%t] || price[%.2f] || size [%.2f] || userID [%d]", order.Bid, order.Limit.Price, order.Size, order.UserID)
+
+	return matches, nil
+}
+
+func (ex *Exchange) handlePlaceStopOrder(market Market, p PlaceOrderRequest, order *orderbook.Order) error {
+	limitPrice := decimal.Zero
+	if p.Type == StopLimitOrder {
+		limitPrice = p.Price
+	}
+
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return fmt.Errorf("market not found")
+	}
+	ob.PlaceStopOrder(p.StopPrice, limitPrice, order)
+
+	// Tracked as an open order of the user, it only shows in the book once triggered
 	ex.mu.Lock()
 	ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
 	ex.mu.Unlock()
 
-	// log.Printf("new LIMIT order => type: [%t] || price[%.2f] || size [%.2f] || userID [%d]", order.Bid, order.Limit.Price, order.Size, order.UserID)
-
 	return nil
 }
 
+// pendingStop looks up a stop order that is still waiting for its trigger in any market
+func (ex *Exchange) pendingStop(id int64) (*orderbook.StopOrder, bool) {
+	for _, ob := range ex.orderbooks {
+		if stop, ok := ob.PendingStop(id); ok {
+			return stop, true
+		}
+	}
+
+	return nil, false
+}
+
 type PlaceOrderResponse struct {
-	OrderID int64
+	OrderID 			int64
+	SizeFilled 		decimal.Decimal
+	// Size cancelled without resting in the book, e.g. the remainder of
+	// a market order stopped by its price collar
+	SizeUnfilled 	decimal.Decimal
+	// Fees of the fills, in the asset the order receives. Maker rebates
+	// are in the asset of the taker fee instead.
+	Fee 					decimal.Decimal
+	FeeAsset 			string `json:",omitempty"`
+}
+
+func newPlaceOrderResponse(order *orderbook.Order, matches []orderbook.Match, fees map[int64]tradeFees) *PlaceOrderResponse {
+	resp := &PlaceOrderResponse{
+		OrderID: order.ID,
+	}
+
+	for _, match := range matches {
+		if match.Bid == order || match.Ask == order {
+			resp.SizeFilled += match.SizeFilled
+		}
+
+		tf := fees[match.TradeID]
+		switch order.ID {
+		case match.Trade.TakerOrderID:
+			resp.Fee += tf.taker
+			resp.FeeAsset = tf.takerAsset
+		case match.Trade.MakerOrderID:
+			resp.Fee += tf.maker
+			resp.FeeAsset = tf.makerAsset
+		}
+	}
+
+	if order.Limit == nil {
+		resp.SizeUnfilled = order.TotalSize()
+	}
+
+	return resp
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
@@ -428,129 +875,415 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, "Invalid request")
 	}
 
+	resp, err := ex.placeOrder(placeOrderData)
+	var rejected *RejectedOrderError
+	if errors.As(err, &rejected) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error(), Code: rejected.Code})
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// placeOrder validates and places an order, orders rejected because of the
+// request or by the orderbook return a *RejectedOrderError
+func (ex *Exchange) placeOrder(placeOrderData PlaceOrderRequest) (*PlaceOrderResponse, error) {
 	market := Market(placeOrderData.Market)
-	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	order, original, err := ex.newOrder(placeOrderData)
+	if order == nil {
+		return original, err
+	}
 
 	// Limit orders
 	if placeOrderData.Type == LimitOrder {
-		if err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]any{"msg": "error placing limit"})
+		matches, err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order)
+		if errors.Is(err, orderbook.ErrPostOnlyWouldCross) {
+			return nil, ex.rejectOrder(order, err.Error())
 		}
+		if err != nil {
+			return nil, fmt.Errorf("error placing limit: %w", err)
+		}
+
+		fees := ex.recordPlacement(order, matches, order.PreventedMatches, order.ReleasedStops)
+
+		resp := newPlaceOrderResponse(order, matches, fees)
+		ex.records.setResult(order.ID, resp)
+
+		return resp, nil
+	}
 
-		resp := &PlaceOrderResponse{
-			OrderID: order.ID,
+	// Stop orders
+	if placeOrderData.Type == StopMarketOrder || placeOrderData.Type == StopLimitOrder {
+		if err := ex.handlePlaceStopOrder(market, placeOrderData, order); err != nil {
+			return nil, ex.rejectOrder(order, err.Error())
 		}
 
-		return c.JSON(http.StatusOK, resp)
+		resp := &PlaceOrderResponse{OrderID: order.ID}
+		ex.records.setResult(order.ID, resp)
+
+		return resp, nil
 	}
 
 	// Market orders
 	if placeOrderData.Type == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
-
-		if err := ex.handleMatches(matches); err != nil {
-			return err
+		matches, _, err := ex.handlePlaceMarketOrder(market, order)
+		if errors.Is(err, orderbook.ErrEmptyBook) || errors.Is(err, orderbook.ErrInsufficientLiquidity) {
+			return nil, ex.rejectOrder(order, err.Error())
+		}
+		if errors.Is(err, orderbook.ErrInsufficientBudget) {
+			// The book moved past the funds reserved for the order
+			ex.records.finish(order.ID, StatusRejected, err.Error())
+			return nil, &RejectedOrderError{Reason: err.Error(), Code: ErrCodeInsufficientFunds}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error placing market order: %w", err)
 		}
 
+		fees := ex.recordPlacement(order, matches, order.PreventedMatches, order.ReleasedStops)
 
-		resp := &PlaceOrderResponse{
-			OrderID: order.ID,
-		}
+		resp := newPlaceOrderResponse(order, matches, fees)
+		ex.records.setResult(order.ID, resp)
 
-		return c.JSON(http.StatusOK, resp)
+		return resp, nil
 	}
 
-
-	return c.JSON(http.StatusBadRequest, map[string]any{"msg": "invalid order type"})
+	return nil, ex.rejectOrder(order, "invalid order type")
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
-	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
-		if !ok {
-			return fmt.Errorf("user not found for ask: %d", match.Ask.UserID)
-		}
+// newOrder validates and records an order, then holds the funds it needs
+// before it reaches the book. A resubmitted order returns no order but the
+// result of the original submission.
+func (ex *Exchange) newOrder(placeOrderData PlaceOrderRequest) (*orderbook.Order, *PlaceOrderResponse, error) {
+	market := Market(placeOrderData.Market)
+	if err := ex.validateOrderMarket(placeOrderData); err != nil {
+		return nil, nil, err
+	}
 
-		toUser, ok := ex.Users[match.Bid.UserID]
-		if !ok {
-			return fmt.Errorf("user not found for bid: %d", match.Bid.UserID)
-		}
+	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	orderID, err := ex.orderIDs.Next()
+	if err != nil {
+		// The ID is still unique until the next restart, so the order goes through
+		logrus.WithError(err).Error("Failed to persist the order ID sequence")
+	}
+	order.ID = orderID
 
-		toAddress := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
+	if original, ok := ex.records.add(market, placeOrderData, order); !ok {
+		resp, err := duplicateOrderResult(original)
+		return nil, resp, err
+	}
 
+	if err := validateOrderParams(placeOrderData); err != nil {
+		return nil, nil, ex.rejectOrder(order, err.Error())
+	}
+	order.TimeInForce = placeOrderData.TimeInForce
+	order.ExpiresAt = placeOrderData.ExpiresAt
+	order.PostOnly = placeOrderData.PostOnly
+	order.PostOnlyReprice = placeOrderData.PostOnlyReprice
+	order.DisplaySize = placeOrderData.DisplaySize
+	order.WorstPrice = placeOrderData.WorstPrice
+	order.MaxSlippageBps = placeOrderData.MaxSlippageBps
+	order.SelfTradePrevention = placeOrderData.SelfTradePrevention
+	if order.SelfTradePrevention == "" {
+		order.SelfTradePrevention = ex.userSettings(order.UserID).SelfTradePrevention
+	}
+	if placeOrderData.Type == StopMarketOrder {
+		worstPrice, err := stopWorstPrice(placeOrderData)
+		if err != nil {
+			return nil, nil, ex.rejectOrder(order, err.Error())
+		}
+		order.WorstPrice, order.MaxSlippageBps = worstPrice, 0
+	}
 
-		// Only needed for the fees later on
-		// exchangePubKey := ex.PrivateKey.Public()
-		// publicKeyECDSA, ok := exchangePubKey.(*ecdsa.PublicKey)
-		// if !ok {
-		// 	return fmt.Errorf("error casting exchange public key to ECDSA")
-		// }
+	if err := ex.reserve(placeOrderData, order); err != nil {
+		return nil, nil, err
+	}
 
-		amount := big.NewInt(int64(match.SizeFilled))
-		transferETH(ex.Client, fromUser.PrivateKey, toAddress, amount)
+	return order, nil, nil
+}
 
+// duplicateOrderResult answers the resubmission of an order with the
+// result of the original submission
+func duplicateOrderResult(original OrderRecord) (*PlaceOrderResponse, error) {
+	if original.Status == StatusRejected {
+		return nil, rejectRequest(original.Reason)
+	}
+	if original.result == nil {
+		return nil, rejectRequest(fmt.Sprintf("order with client order ID %s is already being placed", original.ClientOrderID))
+	}
 
-		// CheckBalances
-		// publicKey := fromUser.PrivateKey.Public()
-		// publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-		// if !ok {
-		// 	return fmt.Errorf("error casting public key to ECDSA")
-		// }
+	return original.result, nil
+}
 
-		// fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
-		// fromBalance, err := ex.Client.BalanceAt(context.Background(), fromAddress, nil)
-		// if err != nil {
-		// 	log.Fatal(err)
-		// }
+// Order rejected because of the request or by the orderbook
+type RejectedOrderError struct {
+	Reason string
+	Code 	 string
+}
 
-		// fmt.Printf(" from address after balance: %s\n",fromBalance)
+func (e *RejectedOrderError) Error() string {
+	return e.Reason
+}
 
-		// toBalance, err := ex.Client.BalanceAt(context.Background(), toAddress, nil)
-		// if err != nil {
-		// 	log.Fatal(err)
-		// }
+func rejectRequest(reason string) error {
+	return &RejectedOrderError{Reason: reason}
+}
 
-		// fmt.Printf(" to address after balance: %s\n",toBalance)
+// rejectOrder records why an order got rejected
+func (ex *Exchange) rejectOrder(order *orderbook.Order, reason string) error {
+	ex.records.finish(order.ID, StatusRejected, reason)
 
+	return rejectRequest(reason)
+}
+
+// validateOrder runs every check of an order request which doesn't need the
+// order to be placed, without side effects
+func (ex *Exchange) validateOrder(p PlaceOrderRequest) error {
+	if err := ex.validateOrderMarket(p); err != nil {
+		return err
 	}
+	if err := validateOrderParams(p); err != nil {
+		return rejectRequest(err.Error())
+	}
+
 	return nil
 }
 
-func transferETH(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
-	ctx := context.Background()
-	publicKey := fromPrivKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
+// validateOrderMarket checks the order against the market it is placed on
+func (ex *Exchange) validateOrderMarket(p PlaceOrderRequest) error {
+	spec, ok := ex.markets.Get(Market(p.Market))
 	if !ok {
-		return fmt.Errorf("error casting public key to ECDSA")
+		return rejectRequest("market not found")
+	}
+	if spec.Status != MarketOpen {
+		return rejectRequest(fmt.Sprintf("market %s is %s", spec.Market, spec.Status))
 	}
 
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
+	if p.Size <= 0 {
+		return rejectRequest("size must be positive")
+	}
 
-	nonce, err := client.PendingNonceAt(ctx, fromAddress)
-	if err != nil {
-		return err
+	if err := ex.validateMarketSpec(spec, p); err != nil {
+		return rejectRequest(err.Error())
 	}
 
-	gasLimit := uint64(21000) // in units
-	gasPrice, err := client.SuggestGasPrice(ctx)
-	if err != nil {
+	return nil
+}
+
+// validateOrderParams checks that the options of the order fit its type
+func validateOrderParams(p PlaceOrderRequest) error {
+	switch p.Type {
+	case LimitOrder, MarketOrder:
+	case StopMarketOrder, StopLimitOrder:
+		if p.StopPrice <= 0 {
+			return fmt.Errorf("stop price must be positive")
+		}
+		if p.Type == StopLimitOrder && p.Price <= 0 {
+			return fmt.Errorf("stop-limit order needs a limit price")
+		}
+	default:
+		return fmt.Errorf("invalid order type")
+	}
+
+	if err := validateTimeInForce(p); err != nil {
 		return err
 	}
 
+	if p.PostOnly && p.Type != LimitOrder {
+		return fmt.Errorf("post-only is only supported by limit orders")
+	}
+
+	if len(p.ClientOrderID) > maxClientOrderIDLength {
+		return fmt.Errorf("client order ID is longer than %d characters", maxClientOrderIDLength)
+	}
 
-	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
+	if !p.SelfTradePrevention.IsValid() {
+		return fmt.Errorf("invalid self-trade prevention: %s", p.SelfTradePrevention)
+	}
 
-	chainID, err := client.NetworkID(ctx) // 31337 for localhost / Anvil
-	if err != nil {
-		log.Fatal(err)
-		return err
+	if p.DisplaySize != 0 {
+		if p.Type != LimitOrder {
+			return fmt.Errorf("iceberg is only supported by limit orders")
+		}
+		if p.DisplaySize < 0 || p.DisplaySize > p.Size {
+			return fmt.Errorf("display size must be between 0 and the order size")
+		}
+	}
+
+	if p.WorstPrice != 0 || p.MaxSlippageBps != 0 {
+		if p.Type != MarketOrder && p.Type != StopMarketOrder {
+			return fmt.Errorf("max slippage is only supported by market and stop-market orders")
+		}
+		if p.WorstPrice != 0 && p.MaxSlippageBps != 0 {
+			return fmt.Errorf("max slippage is either a worst price or basis points, not both")
+		}
+		if p.WorstPrice < 0 || p.MaxSlippageBps < 0 {
+			return fmt.Errorf("max slippage must be positive")
+		}
+		if p.MaxSlippageBps > 10_000 {
+			return fmt.Errorf("max slippage must be at most 10000 bps")
+		}
+		if p.Type == StopMarketOrder && p.WorstPrice != 0 && (p.Bid && p.WorstPrice < p.StopPrice || !p.Bid && p.WorstPrice > p.StopPrice) {
+			return fmt.Errorf("worst price of a stop-market order is beyond its stop price")
+		}
+	}
+
+	return nil
+}
+
+// stopWorstPrice returns the collar of a stop-market order, 0 when it has none
+func stopWorstPrice(p PlaceOrderRequest) (decimal.Decimal, error) {
+	if p.WorstPrice != 0 {
+		return p.WorstPrice, nil
+	}
+
+	bps := p.MaxSlippageBps
+	if bps == 0 {
+		if !p.Bid {
+			return decimal.Zero, nil
+		}
+		bps = defaultStopSlippageBps
 	}
 
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), fromPrivKey)
+	price, err := p.StopPrice.CheckedMulDiv(10_000+bps, 10_000)
+	if !p.Bid {
+		price, err = p.StopPrice.CheckedMulDiv(10_000-bps, 10_000)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return decimal.Zero, fmt.Errorf("stop price %s is too large", p.StopPrice)
 	}
 
+	return price, nil
+}
+
+func validateTimeInForce(p PlaceOrderRequest) error {
+	switch p.TimeInForce {
+	case "", orderbook.GoodTillCancel, orderbook.ImmediateOrCancel, orderbook.FillOrKill:
+		if p.ExpiresAt != 0 {
+			return fmt.Errorf("expiry is only supported by GTD orders")
+		}
+	case orderbook.GoodTillDate:
+		if p.Type != LimitOrder {
+			return fmt.Errorf("GTD is only supported by limit orders")
+		}
+		if p.ExpiresAt <= time.Now().UnixNano() {
+			return fmt.Errorf("GTD order expiry must be in the future")
+		}
+	default:
+		return fmt.Errorf("invalid time in force: %s", p.TimeInForce)
+	}
+
+	return nil
+}
+
+// sweepExpiredOrders cancels the GTD orders once they expire
+// and drops them from the users' open orders. It also prunes
+// the records of the orders past their retention.
+func (ex *Exchange) sweepExpiredOrders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		<- ticker.C
+
+		now := time.Now().UnixNano()
+		ex.records.prune(now)
+
+		for market, ob := range ex.orderbooks {
+			expired := ob.ExpireOrders(now)
+			if len(expired) == 0 {
+				continue
+			}
+
+			ex.removeOrders(expired)
+
+			for _, order := range expired {
+				ex.records.finish(order.ID, StatusExpired, "")
+
+				logrus.WithFields(logrus.Fields{
+					"market": market,
+					"id": 		order.ID,
+					"userID": order.UserID,
+				}).Info("GTD order expired")
+			}
+		}
+	}
+}
+
+// removeOrders drops the given orders from the users' open orders
+func (ex *Exchange) removeOrders(orders []*orderbook.Order) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	for _, order := range orders {
+		userOrders := ex.Orders[order.UserID]
+		for i := 0; i < len(userOrders); i++ {
+			if userOrders[i] == order {
+				userOrders = append(userOrders[:i], userOrders[i+1:]...)
+				break
+			}
+		}
+		ex.Orders[order.UserID] = userOrders
+	}
+}
+
+// recordPlacement books the trades of an order which went through the
+// orderbook with their fees, updates its status and the one of the orders
+// it matched, prevented a self trade with or released from the trigger
+// book, then settles its matches. It returns the fees by trade ID.
+func (ex *Exchange) recordPlacement(order *orderbook.Order, matches []orderbook.Match, prevented []orderbook.PreventedMatch, released []*orderbook.StopOrder) map[int64]tradeFees {
+	// Booked first, the holds of the orders reaching a terminal state are released with the records.
+	// The trades already happened in the book, one the ledger can't book breaks its invariants
+	// but the others are still booked and recorded.
+	fees := make(map[int64]tradeFees, len(matches))
+	for _, match := range matches {
+		spec, _ := ex.markets.Get(Market(match.Trade.Market))
+		tf := ex.fees.charge(spec, match.Trade)
+		if err := ex.ledger.settleTrade(spec, match.Trade, tf); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"tradeID": match.TradeID,
+				"market": 	match.Trade.Market,
+			}).Error("Failed to book a trade in the ledger")
+			continue
+		}
+		fees[match.TradeID] = tf
+	}
+
+	ex.records.fill(matches)
+	ex.records.prevent(prevented)
+	ex.records.placed(order)
+
+	cancelled := []*orderbook.Order{}
+	for _, pm := range prevented {
+		if pm.MakerCancelled {
+			cancelled = append(cancelled, pm.Maker)
+		}
+	}
+
+	// A released stop which isn't resting in the book is done, even when
+	// it found nothing to match
+	for _, stop := range released {
+		ex.records.prevent(stop.Order.PreventedMatches)
+		ex.records.placed(stop.Order)
+
+		for _, pm := range stop.Order.PreventedMatches {
+			if pm.MakerCancelled {
+				cancelled = append(cancelled, pm.Maker)
+			}
+		}
+		if stop.Order.Limit == nil {
+			cancelled = append(cancelled, stop.Order)
+		}
+	}
+	ex.removeOrders(cancelled)
+
+	ex.handleMatches(matches, fees)
+
+	return fees
+}
 
-	return client.SendTransaction(ctx, signedTx)
+// handleMatches records the fills of the matches and queues their settlement
+func (ex *Exchange) handleMatches(matches []orderbook.Match, fees map[int64]tradeFees) {
+	ex.fills.record(matches, fees)
+	ex.enqueueSettlements(matches)
 }
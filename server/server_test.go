@@ -0,0 +1,94 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// Users of the test exchange, funded with the starting balances
+var testUserKeys = map[int64]string{
+	1: "59c6995e998f97a5a0044966f0945389dc9e86dae88c7a8412f4603b6b78690d",
+	8: "dbda1821b80551c9d65939329250298aa3472ba22feea921c0cf5d620ea67b97",
+	9: "2a871d0798f97d79848a013d4936a73bf4cc922c825d33c1cf7073dff6d409c6",
+}
+
+// newTestExchange creates an exchange whose data files are kept in a
+// temporary directory
+func newTestExchange(t *testing.T, settlement Settlement) *Exchange {
+	ex, err := NewExchange(exchangePrivKey, t.TempDir(), settlement, DefaultMarkets, DefaultFeeSchedule)
+	assert.Nil(t, err)
+
+	for userID, pk := range testUserKeys {
+		ex.registerUser(pk, userID)
+		ex.fund(userID, startingBalances)
+	}
+
+	return ex
+}
+
+// Exchange with a BTC market next to the ETH one, sharing its quote asset
+func newTwoMarketExchange(t *testing.T) *Exchange {
+	btc := DefaultMarkets[0]
+	btc.Market, btc.BaseAsset = "BTC", "BTC"
+
+	ex, err := NewExchange(exchangePrivKey, t.TempDir(), internalSettlement{}, []MarketSpec{DefaultMarkets[0], btc}, DefaultFeeSchedule)
+	assert.Nil(t, err)
+
+	for userID, pk := range testUserKeys {
+		ex.registerUser(pk, userID)
+		ex.fund(userID, startingBalances)
+		ex.fund(userID, map[string]decimal.Decimal{"BTC": 10 * decimal.One})
+	}
+
+	return ex
+}
+
+func limitOrder(userID int64, bid bool, size, price string) PlaceOrderRequest {
+	return PlaceOrderRequest{
+		Type: 	LimitOrder,
+		Bid: 		bid,
+		Size: 	decimal.MustParse(size),
+		Price: 	decimal.MustParse(price),
+		Market: MarketETH,
+		UserID: userID,
+	}
+}
+
+func btcOrder(userID int64, bid bool, size, price string) PlaceOrderRequest {
+	p := limitOrder(userID, bid, size, price)
+	p.Market = "BTC"
+	return p
+}
+
+func placeTestOrder(t *testing.T, ex *Exchange, p PlaceOrderRequest) *PlaceOrderResponse {
+	resp, err := ex.placeOrder(p)
+	assert.Nil(t, err)
+
+	return resp
+}
+
+func TestExchangeDataDir(t *testing.T) {
+	dir := t.TempDir()
+	ex, err := NewExchange(exchangePrivKey, dir, internalSettlement{}, DefaultMarkets, DefaultFeeSchedule)
+	assert.Nil(t, err)
+	ex.registerUser(testUserKeys[1], 1)
+	ex.fund(1, startingBalances)
+	first := placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+
+	for _, file := range []string{orderIDsFile, settlementsFile} {
+		_, err := os.Stat(filepath.Join(dir, file))
+		assert.Nil(t, err, file)
+	}
+
+	// A restart on the same directory doesn't hand out the IDs again
+	ex, err = NewExchange(exchangePrivKey, dir, internalSettlement{}, DefaultMarkets, DefaultFeeSchedule)
+	assert.Nil(t, err)
+	ex.registerUser(testUserKeys[1], 1)
+	ex.fund(1, startingBalances)
+	second := placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	assert.True(t, second.OrderID > first.OrderID)
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+const (
+	// Transfers are sent to the node at RPCURL, e.g. anvil
+	ChainSettlement 		SettlementBackend = "CHAIN"
+	// Transfers are mined by an in-memory go-ethereum chain
+	SimulatedSettlement SettlementBackend = "SIMULATED"
+	// Trades only move balances in the ledger of the exchange
+	InternalSettlement 	SettlementBackend = "INTERNAL"
+
+	// Optional configuration of the settlement, DefaultSettlementConfig is used without it
+	settlementConfigFile = "settlement.json"
+
+	// Not known by the node, it can be sent (again)
+	TransferUnknown 	TransferState = "UNKNOWN"
+	// Waiting in the pool of the node to be mined
+	TransferPending 	TransferState = "PENDING"
+	TransferMined 		TransferState = "MINED"
+	// Its nonce went to another transaction, so it can never be mined
+	TransferDropped 	TransferState = "DROPPED"
+)
+
+type (
+	SettlementBackend string
+
+	SettlementConfig struct {
+		Backend SettlementBackend
+		// Address of the node of the CHAIN backend
+		RPCURL 	string
+	}
+
+	// Transfer signed but maybe not sent yet. It is kept until it is mined
+	// so that a retry sends it again instead of signing a second one.
+	Transfer struct {
+		Hash 	common.Hash
+		From 	common.Address
+		Nonce uint64
+		// Signed transaction, empty for the INTERNAL backend
+		Raw 	[]byte
+	}
+
+	TransferState string
+
+	// Settlement moves what the users traded between their wallets
+	Settlement interface {
+		// SignTransfer signs the transfer of amount wei from the wallet of
+		// from to the address to with the next nonce of the wallet, it isn't sent
+		SignTransfer(ctx context.Context, from *ecdsa.PrivateKey, to common.Address, amount *big.Int) (Transfer, error)
+		// SendTransfer broadcasts a signed transfer
+		SendTransfer(ctx context.Context, transfer Transfer) error
+		// TransferState tells where a transfer is at, ErrTransferReverted
+		// is returned when it was mined but failed
+		TransferState(ctx context.Context, transfer Transfer) (TransferState, error)
+	}
+
+	// Part of the node API used to send transfers, both ethclient
+	// and the simulated backend implement it
+	chainClient interface {
+		ethereum.PendingStateReader
+		ethereum.ChainStateReader
+		ethereum.GasPricer
+		ethereum.TransactionSender
+		ethereum.TransactionReader
+		ethereum.ChainIDReader
+	}
+
+	chainSettlement struct {
+		client chainClient
+	}
+
+	internalSettlement struct{}
+)
+
+var ErrTransferReverted = errors.New("transfer reverted")
+
+var DefaultSettlementConfig = SettlementConfig{
+	Backend: ChainSettlement,
+	RPCURL: 	"http://localhost:8545",
+}
+
+// LoadSettlementConfig reads the settlement configuration from a JSON
+// SettlementConfig, DefaultSettlementConfig is returned when the file doesn't exist
+func LoadSettlementConfig(path string) (SettlementConfig, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultSettlementConfig, nil
+	}
+	if err != nil {
+		return SettlementConfig{}, err
+	}
+
+	var cfg SettlementConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return SettlementConfig{}, fmt.Errorf("invalid settlement configuration %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// NewSettlement creates the backend of the configuration, the wallets are
+// only funded by the simulated chain as it starts from an empty state
+func NewSettlement(cfg SettlementConfig, wallets []common.Address) (Settlement, error) {
+	switch cfg.Backend {
+	case ChainSettlement:
+		// Doesn't connect yet, the exchange starts even if the node is down
+		client, err := ethclient.Dial(cfg.RPCURL)
+		if err != nil {
+			return nil, err
+		}
+		return &chainSettlement{client: client}, nil
+	case SimulatedSettlement:
+		return newSimulatedSettlement(wallets)
+	case InternalSettlement:
+		return internalSettlement{}, nil
+	}
+
+	return nil, fmt.Errorf("invalid settlement backend: %s", cfg.Backend)
+}
+
+func (s *chainSettlement) SignTransfer(ctx context.Context, from *ecdsa.PrivateKey, to common.Address, amount *big.Int) (Transfer, error) {
+	fromAddress := crypto.PubkeyToAddress(from.PublicKey)
+
+	nonce, err := s.client.PendingNonceAt(ctx, fromAddress)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	gasLimit := uint64(21000) // in units
+	gasPrice, err := s.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
+
+	chainID, err := s.client.ChainID(ctx) // 31337 for localhost / Anvil
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), from)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	return Transfer{
+		Hash: 	signedTx.Hash(),
+		From: 	fromAddress,
+		Nonce: 	nonce,
+		Raw: 		raw,
+	}, nil
+}
+
+func (s *chainSettlement) SendTransfer(ctx context.Context, transfer Transfer) error {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(transfer.Raw); err != nil {
+		return err
+	}
+
+	return s.client.SendTransaction(ctx, tx)
+}
+
+func (s *chainSettlement) TransferState(ctx context.Context, transfer Transfer) (TransferState, error) {
+	receipt, err := s.client.TransactionReceipt(ctx, transfer.Hash)
+	if err == nil {
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return TransferMined, ErrTransferReverted
+		}
+		return TransferMined, nil
+	}
+	if !errors.Is(err, ethereum.NotFound) {
+		return "", err
+	}
+
+	_, _, err = s.client.TransactionByHash(ctx, transfer.Hash)
+	if err == nil {
+		return TransferPending, nil
+	}
+	if !errors.Is(err, ethereum.NotFound) {
+		return "", err
+	}
+
+	// Not mined while a later nonce of the wallet was, nothing can mine it anymore
+	nonce, err := s.client.NonceAt(ctx, transfer.From, nil)
+	if err != nil {
+		return "", err
+	}
+	if nonce > transfer.Nonce {
+		return TransferDropped, nil
+	}
+
+	return TransferUnknown, nil
+}
+
+// SignTransfer signs nothing, the trade is already booked in the ledger
+func (internalSettlement) SignTransfer(ctx context.Context, from *ecdsa.PrivateKey, to common.Address, amount *big.Int) (Transfer, error) {
+	return Transfer{}, nil
+}
+
+func (internalSettlement) SendTransfer(ctx context.Context, transfer Transfer) error {
+	return nil
+}
+
+func (internalSettlement) TransferState(ctx context.Context, transfer Transfer) (TransferState, error) {
+	return TransferMined, nil
+}
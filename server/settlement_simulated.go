@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+// Balance of every wallet in the genesis of the simulated chain
+var simulatedWalletBalance = new(big.Int).Mul(big.NewInt(10_000), big.NewInt(1e18))
+
+// In-memory chain, a block is mined after every transfer
+type simulatedSettlement struct {
+	*chainSettlement
+	backend *simulated.Backend
+}
+
+func newSimulatedSettlement(wallets []common.Address) (Settlement, error) {
+	alloc := make(types.GenesisAlloc, len(wallets))
+	for _, wallet := range wallets {
+		alloc[wallet] = types.Account{Balance: simulatedWalletBalance}
+	}
+
+	backend := simulated.NewBackend(alloc)
+
+	return &simulatedSettlement{
+		chainSettlement: 	&chainSettlement{client: backend.Client()},
+		backend: 					backend,
+	}, nil
+}
+
+func (s *simulatedSettlement) SendTransfer(ctx context.Context, transfer Transfer) error {
+	if err := s.chainSettlement.SendTransfer(ctx, transfer); err != nil {
+		return err
+	}
+
+	s.backend.Commit()
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulatedSettlementTransfer(t *testing.T) {
+	ctx := context.Background()
+	from, err := crypto.HexToECDSA(testUserKeys[1])
+	assert.Nil(t, err)
+	fromAddress := crypto.PubkeyToAddress(from.PublicKey)
+	to := common.HexToAddress("0x0000000000000000000000000000000000000042")
+
+	settlement, err := newSimulatedSettlement([]common.Address{fromAddress})
+	assert.Nil(t, err)
+	backend := settlement.(*simulatedSettlement).backend
+	defer backend.Close()
+
+	amount := big.NewInt(1e18)
+	transfer, err := settlement.SignTransfer(ctx, from, to, amount)
+	assert.Nil(t, err)
+	assert.Equal(t, transfer.From, fromAddress)
+	assert.Equal(t, transfer.Nonce, uint64(0))
+
+	// Signed again with the same nonce, only one of the two can be mined
+	replaced, err := settlement.SignTransfer(ctx, from, to, big.NewInt(2e18))
+	assert.Nil(t, err)
+	assert.Equal(t, replaced.Nonce, transfer.Nonce)
+	assert.NotEqual(t, replaced.Hash, transfer.Hash)
+
+	assert.Nil(t, settlement.SendTransfer(ctx, transfer))
+	state, err := settlement.TransferState(ctx, transfer)
+	assert.Nil(t, err)
+	assert.Equal(t, state, TransferMined)
+
+	balance, err := backend.Client().BalanceAt(ctx, to, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, balance, amount)
+
+	state, err = settlement.TransferState(ctx, replaced)
+	assert.Nil(t, err)
+	assert.Equal(t, state, TransferDropped)
+
+	// The next transfer takes the next nonce, signed only the node doesn't know it
+	next, err := settlement.SignTransfer(ctx, from, to, amount)
+	assert.Nil(t, err)
+	assert.Equal(t, next.Nonce, uint64(1))
+	state, err = settlement.TransferState(ctx, next)
+	assert.Nil(t, err)
+	assert.Equal(t, state, TransferUnknown)
+}
+
+func TestSimulatedSettlementOfTrade(t *testing.T) {
+	wallets := []common.Address{}
+	for _, pk := range testUserKeys {
+		key, err := crypto.HexToECDSA(pk)
+		assert.Nil(t, err)
+		wallets = append(wallets, crypto.PubkeyToAddress(key.PublicKey))
+	}
+	settlement, err := NewSettlement(SettlementConfig{Backend: SimulatedSettlement}, wallets)
+	assert.Nil(t, err)
+	defer settlement.(*simulatedSettlement).backend.Close()
+	ex := newTestExchange(t, settlement)
+
+	ex.submitSettlement(enqueueTestSettlement(ex))
+	record, _ := ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementSubmitted)
+	assert.NotEqual(t, len(record.RawTx), 0)
+
+	ex.confirmSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementConfirmed)
+}
+
+func TestNewSettlement(t *testing.T) {
+	settlement, err := NewSettlement(SettlementConfig{Backend: InternalSettlement}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, settlement, internalSettlement{})
+
+	settlement, err = NewSettlement(SettlementConfig{Backend: SimulatedSettlement}, nil)
+	assert.Nil(t, err)
+	if assert.IsType(t, settlement, &simulatedSettlement{}) {
+		settlement.(*simulatedSettlement).backend.Close()
+	}
+
+	// The node doesn't have to be up
+	settlement, err = NewSettlement(DefaultSettlementConfig, nil)
+	assert.Nil(t, err)
+	assert.IsType(t, settlement, &chainSettlement{})
+
+	_, err = NewSettlement(SettlementConfig{Backend: ChainSettlement, RPCURL: "ftp://localhost:8545"}, nil)
+	assert.NotNil(t, err)
+	_, err = NewSettlement(SettlementConfig{Backend: "LIGHTNING"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestLoadSettlementConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg, err := LoadSettlementConfig(filepath.Join(dir, settlementConfigFile))
+	assert.Nil(t, err)
+	assert.Equal(t, cfg, DefaultSettlementConfig)
+
+	path := filepath.Join(dir, "simulated.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"Backend": "SIMULATED"}`), 0644))
+	cfg, err = LoadSettlementConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, cfg, SettlementConfig{Backend: SimulatedSettlement})
+
+	path = filepath.Join(dir, "invalid.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"Backend": `), 0644))
+	_, err = LoadSettlementConfig(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Waiting for its transfer to be sent, or for the next attempt after a failed one
+	SettlementPending 	SettlementStatus = "PENDING"
+	// Transfer sent, waiting for it to be mined until ConfirmBy
+	SettlementSubmitted SettlementStatus = "SUBMITTED"
+	SettlementConfirmed SettlementStatus = "CONFIRMED"
+	// Out of attempts or reverted, needs to be looked at by hand
+	SettlementFailed 		SettlementStatus = "FAILED"
+
+	// Journal of the settlements in the data directory, replayed when the exchange restarts
+	settlementsFile = "settlements"
+
+	// How often the queue sends the pending transfers and checks the submitted ones
+	settlementInterval = 500 * time.Millisecond
+	// Time given to each call to the settlement backend
+	settlementTimeout = 10 * time.Second
+	// Time given to a sent transfer to be mined, it is then sent again
+	settlementConfirmTimeout = 2 * time.Minute
+
+	maxSettlementAttempts = 10
+	// The delay between two attempts doubles from the first one up to the max
+	settlementFirstRetry 	= 1 * time.Second
+	settlementMaxRetry 		= 5 * time.Minute
+)
+
+type (
+	SettlementStatus string
+
+	// On-chain settlement of a trade, from the seller to the buyer
+	SettlementRecord struct {
+		TradeID 		int64
+		Market 			Market
+		FromUserID 	int64
+		ToUserID 		int64
+		// In the base asset of the market
+		Amount 			decimal.Decimal
+		Status 			SettlementStatus
+		// Transfer signed for the settlement, journaled before it is sent and
+		// sent again on retries until it is mined or its nonce is taken
+		TxHash 			string `json:",omitempty"`
+		TxNonce 		uint64 `json:",omitempty"`
+		RawTx 			hexutil.Bytes `json:",omitempty"`
+		// Failed attempts at sending the transfer
+		Attempts 		int
+		// Error of the last failed attempt
+		Error 			string `json:",omitempty"`
+		// Unix nano time of the next attempt of a pending settlement
+		NextAttemptAt int64 `json:",omitempty"`
+		// Unix nano time a submitted transfer has to be mined by
+		ConfirmBy 	int64 `json:",omitempty"`
+		CreatedAt 	int64
+		UpdatedAt 	int64
+	}
+
+	// Settlements by trade ID. Every change of a settlement is appended
+	// to a journal first, so that none is lost when the exchange restarts.
+	settlementQueue struct {
+		mu 				sync.RWMutex
+		path 			string
+		journal 	*os.File
+		records 	map[int64]*SettlementRecord
+	}
+)
+
+// newSettlementQueue replays the journal at path, which is then compacted
+// down to the last state of each settlement
+func newSettlementQueue(path string) (*settlementQueue, error) {
+	q := &settlementQueue{
+		path: 		path,
+		records: 	make(map[int64]*SettlementRecord),
+	}
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	q.journal = journal
+
+	return q, nil
+}
+
+func (q *settlementQueue) replay() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := &SettlementRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// The last line may have been cut by a crash while it was written
+			logrus.WithError(err).Error("Skipped invalid settlement journal entry")
+			continue
+		}
+		q.records[record.TradeID] = record
+	}
+
+	return scanner.Err()
+}
+
+func (q *settlementQueue) compact() error {
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, record := range q.records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.path)
+}
+
+// save journals the new state of a settlement and keeps it, under the lock
+func (q *settlementQueue) save(record *SettlementRecord) {
+	record.UpdatedAt = time.Now().UnixNano()
+	q.records[record.TradeID] = record
+
+	data, err := json.Marshal(record)
+	if err == nil {
+		_, err = q.journal.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"tradeID": record.TradeID,
+		}).Error("Failed to journal settlement")
+	}
+}
+
+func (q *settlementQueue) enqueue(record SettlementRecord) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	record.Status = SettlementPending
+	record.NextAttemptAt = now
+	record.CreatedAt = now
+	q.save(&record)
+}
+
+func (q *settlementQueue) get(tradeID int64) (SettlementRecord, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	record, ok := q.records[tradeID]
+	if !ok {
+		return SettlementRecord{}, false
+	}
+
+	return *record, true
+}
+
+// due returns the settlements to work on: the pending ones whose attempt
+// is due and the submitted ones, oldest trade first
+func (q *settlementQueue) due(now int64) []SettlementRecord {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	due := []SettlementRecord{}
+	for _, record := range q.records {
+		if record.Status == SettlementSubmitted || record.Status == SettlementPending && record.NextAttemptAt <= now {
+			due = append(due, *record)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].TradeID < due[j].TradeID
+	})
+
+	return due
+}
+
+func (q *settlementQueue) update(record SettlementRecord) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.save(&record)
+}
+
+// settlementBackoff is the delay before the next attempt after the given number of failed ones
+func settlementBackoff(attempts int) time.Duration {
+	delay := settlementFirstRetry
+	for i := 1; i < attempts && delay < settlementMaxRetry; i++ {
+		delay *= 2
+	}
+
+	return min(delay, settlementMaxRetry)
+}
+
+// enqueueSettlements queues the on-chain settlement of the trades of matches
+func (ex *Exchange) enqueueSettlements(matches []orderbook.Match) {
+	for _, match := range matches {
+		// Only ETH can be moved on chain, the other markets are not settled yet
+		if spec, _ := ex.markets.Get(Market(match.Trade.Market)); spec.BaseAsset != "ETH" {
+			continue
+		}
+
+		ex.settlements.enqueue(SettlementRecord{
+			TradeID: 		match.TradeID,
+			Market: 		Market(match.Trade.Market),
+			FromUserID: match.Ask.UserID,
+			ToUserID: 	match.Bid.UserID,
+			Amount: 		match.SizeFilled,
+		})
+	}
+}
+
+// runSettlements works through the settlement queue in the background, a
+// chain outage only delays the settlements until their attempts run out
+func (ex *Exchange) runSettlements(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		<- ticker.C
+
+		for _, record := range ex.settlements.due(time.Now().UnixNano()) {
+			switch record.Status {
+			case SettlementPending:
+				ex.submitSettlement(record)
+			case SettlementSubmitted:
+				ex.confirmSettlement(record)
+			}
+		}
+	}
+}
+
+// transfer returns the signed transfer of a settlement, from the wallet of its seller
+func (r SettlementRecord) transfer(from common.Address) Transfer {
+	return Transfer{
+		Hash: 	common.HexToHash(r.TxHash),
+		From: 	from,
+		Nonce: 	r.TxNonce,
+		Raw: 		r.RawTx,
+	}
+}
+
+// submitSettlement sends the transfer of a pending settlement. A transfer
+// signed by an earlier attempt may have reached the chain even though
+// sending it failed, so it is only signed again once its nonce went to
+// another transaction. Until then the same transfer is sent again.
+func (ex *Exchange) submitSettlement(record SettlementRecord) {
+	fromUser, ok := ex.Users[record.FromUserID]
+	if !ok {
+		ex.failSettlement(record, fmt.Errorf("user not found: %d", record.FromUserID), true)
+		return
+	}
+	toUser, ok := ex.Users[record.ToUserID]
+	if !ok {
+		ex.failSettlement(record, fmt.Errorf("user not found: %d", record.ToUserID), true)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settlementTimeout)
+	defer cancel()
+
+	fromAddress := crypto.PubkeyToAddress(fromUser.PrivateKey.PublicKey)
+
+	if record.TxHash != "" {
+		state, err := ex.settlement.TransferState(ctx, record.transfer(fromAddress))
+		if errors.Is(err, ErrTransferReverted) {
+			ex.failSettlement(record, err, true)
+			return
+		}
+		if err != nil {
+			ex.failSettlement(record, err, false)
+			return
+		}
+
+		switch state {
+		case TransferMined:
+			ex.confirmedSettlement(record)
+			return
+		case TransferPending:
+			ex.submittedSettlement(record)
+			return
+		case TransferDropped:
+			record.TxHash, record.TxNonce, record.RawTx = "", 0, nil
+		}
+	}
+
+	if record.TxHash == "" {
+		toAddress := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
+		transfer, err := ex.settlement.SignTransfer(ctx, fromUser.PrivateKey, toAddress, record.Amount.ToBaseUnits(ethDecimals))
+		if err != nil {
+			ex.failSettlement(record, err, false)
+			return
+		}
+
+		record.TxHash = transfer.Hash.Hex()
+		record.TxNonce = transfer.Nonce
+		record.RawTx = transfer.Raw
+		ex.settlements.update(record)
+	}
+
+	if err := ex.settlement.SendTransfer(ctx, record.transfer(fromAddress)); err != nil {
+		ex.failSettlement(record, err, false)
+		return
+	}
+
+	ex.submittedSettlement(record)
+}
+
+func (ex *Exchange) submittedSettlement(record SettlementRecord) {
+	record.Status = SettlementSubmitted
+	record.Error = ""
+	record.NextAttemptAt = 0
+	record.ConfirmBy = time.Now().Add(settlementConfirmTimeout).UnixNano()
+	ex.settlements.update(record)
+
+	logrus.WithFields(logrus.Fields{
+		"tradeID": 	record.TradeID,
+		"tx": 			record.TxHash,
+	}).Info("Submitted settlement")
+}
+
+// confirmSettlement checks whether the transfer of a submitted settlement
+// got mined. One which isn't by ConfirmBy, or whose nonce went to another
+// transaction, goes back to pending for another attempt.
+func (ex *Exchange) confirmSettlement(record SettlementRecord) {
+	fromUser, ok := ex.Users[record.FromUserID]
+	if !ok {
+		ex.failSettlement(record, fmt.Errorf("user not found: %d", record.FromUserID), true)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settlementTimeout)
+	defer cancel()
+
+	fromAddress := crypto.PubkeyToAddress(fromUser.PrivateKey.PublicKey)
+	state, err := ex.settlement.TransferState(ctx, record.transfer(fromAddress))
+	if errors.Is(err, ErrTransferReverted) {
+		ex.failSettlement(record, err, true)
+		return
+	}
+
+	switch {
+	case err == nil && state == TransferMined:
+		ex.confirmedSettlement(record)
+	case err == nil && state == TransferDropped:
+		ex.failSettlement(record, fmt.Errorf("transfer %s dropped, its nonce %d was used by another transaction", record.TxHash, record.TxNonce), false)
+	case time.Now().UnixNano() > record.ConfirmBy:
+		ex.failSettlement(record, fmt.Errorf("transfer %s not mined after %s", record.TxHash, settlementConfirmTimeout), false)
+	}
+}
+
+func (ex *Exchange) confirmedSettlement(record SettlementRecord) {
+	record.Status = SettlementConfirmed
+	record.Error = ""
+	record.NextAttemptAt = 0
+	record.ConfirmBy = 0
+	ex.settlements.update(record)
+
+	logrus.WithFields(logrus.Fields{
+		"tradeID": 	record.TradeID,
+		"tx": 			record.TxHash,
+	}).Info("Confirmed settlement")
+}
+
+// failSettlement schedules the next attempt of a settlement after a
+// failure, it fails for good when final or out of attempts
+func (ex *Exchange) failSettlement(record SettlementRecord, err error, final bool) {
+	record.Attempts++
+	record.Error = err.Error()
+	record.ConfirmBy = 0
+
+	if final || record.Attempts >= maxSettlementAttempts {
+		record.Status = SettlementFailed
+		record.NextAttemptAt = 0
+	} else {
+		record.Status = SettlementPending
+		record.NextAttemptAt = time.Now().Add(settlementBackoff(record.Attempts)).UnixNano()
+	}
+	ex.settlements.update(record)
+
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"tradeID": 	record.TradeID,
+		"attempts": record.Attempts,
+		"status": 	record.Status,
+	}).Error("Failed to settle trade")
+}
+
+func (ex *Exchange) handleGetSettlement(c echo.Context) error {
+	tradeID, err := strconv.ParseInt(c.Param("tradeID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid trade ID"})
+	}
+
+	record, ok := ex.settlements.get(tradeID)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "settlement not found"})
+	}
+
+	return c.JSON(http.StatusOK, record)
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// Settlement backend whose transfers are in whatever state the test sets
+type fakeSettlement struct {
+	signed 		int
+	sent 			[]common.Hash
+	sendErr 	error
+	states 		map[common.Hash]TransferState
+	reverted 	bool
+}
+
+func newFakeSettlement() *fakeSettlement {
+	return &fakeSettlement{states: make(map[common.Hash]TransferState)}
+}
+
+func (s *fakeSettlement) SignTransfer(ctx context.Context, from *ecdsa.PrivateKey, to common.Address, amount *big.Int) (Transfer, error) {
+	s.signed++
+
+	return Transfer{
+		Hash: 	common.BigToHash(big.NewInt(int64(s.signed))),
+		From: 	crypto.PubkeyToAddress(from.PublicKey),
+		Nonce: 	uint64(s.signed),
+		Raw: 		[]byte{byte(s.signed)},
+	}, nil
+}
+
+func (s *fakeSettlement) SendTransfer(ctx context.Context, transfer Transfer) error {
+	s.sent = append(s.sent, transfer.Hash)
+
+	return s.sendErr
+}
+
+func (s *fakeSettlement) TransferState(ctx context.Context, transfer Transfer) (TransferState, error) {
+	if s.reverted {
+		return TransferMined, ErrTransferReverted
+	}
+
+	state, ok := s.states[transfer.Hash]
+	if !ok {
+		return TransferUnknown, nil
+	}
+
+	return state, nil
+}
+
+func enqueueTestSettlement(ex *Exchange) SettlementRecord {
+	ex.settlements.enqueue(SettlementRecord{
+		TradeID: 		1,
+		Market: 		MarketETH,
+		FromUserID: 1,
+		ToUserID: 	8,
+		Amount: 		decimal.One,
+	})
+	record, _ := ex.settlements.get(1)
+
+	return record
+}
+
+func TestSettlementConfirmed(t *testing.T) {
+	settlement := newFakeSettlement()
+	ex := newTestExchange(t, settlement)
+
+	ex.submitSettlement(enqueueTestSettlement(ex))
+	record, _ := ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementSubmitted)
+	assert.Equal(t, record.TxNonce, uint64(1))
+	assert.True(t, record.ConfirmBy > time.Now().UnixNano())
+
+	// Not mined yet
+	ex.confirmSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementSubmitted)
+
+	settlement.states[common.HexToHash(record.TxHash)] = TransferMined
+	ex.confirmSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementConfirmed)
+	assert.Equal(t, settlement.signed, 1)
+}
+
+func TestSettlementSendFailureIsNotSignedAgain(t *testing.T) {
+	settlement := newFakeSettlement()
+	settlement.sendErr = errors.New("connection reset")
+	ex := newTestExchange(t, settlement)
+
+	ex.submitSettlement(enqueueTestSettlement(ex))
+	record, _ := ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementPending)
+	assert.Equal(t, record.Attempts, 1)
+	assert.Equal(t, record.Error, "connection reset")
+	// Journaled before it was sent
+	assert.NotEqual(t, record.TxHash, "")
+	hash := common.HexToHash(record.TxHash)
+
+	// The node didn't get it, the same transfer is sent again
+	settlement.sendErr = nil
+	ex.submitSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementSubmitted)
+	assert.Equal(t, settlement.sent, []common.Hash{hash, hash})
+
+	// The node did get it, it is only waited for
+	record.Status = SettlementPending
+	settlement.states[hash] = TransferPending
+	ex.submitSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementSubmitted)
+	assert.Equal(t, len(settlement.sent), 2)
+
+	assert.Equal(t, settlement.signed, 1)
+}
+
+func TestSettlementDroppedIsSignedAgain(t *testing.T) {
+	settlement := newFakeSettlement()
+	ex := newTestExchange(t, settlement)
+
+	ex.submitSettlement(enqueueTestSettlement(ex))
+	record, _ := ex.settlements.get(1)
+	first := record.TxHash
+
+	settlement.states[common.HexToHash(first)] = TransferDropped
+	ex.confirmSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementPending)
+	assert.Equal(t, record.Attempts, 1)
+
+	ex.submitSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementSubmitted)
+	assert.NotEqual(t, record.TxHash, first)
+	assert.Equal(t, record.TxNonce, uint64(2))
+	assert.Equal(t, settlement.signed, 2)
+}
+
+func TestSettlementConfirmDeadline(t *testing.T) {
+	settlement := newFakeSettlement()
+	ex := newTestExchange(t, settlement)
+
+	ex.submitSettlement(enqueueTestSettlement(ex))
+	record, _ := ex.settlements.get(1)
+	settlement.states[common.HexToHash(record.TxHash)] = TransferPending
+
+	record.ConfirmBy = time.Now().Add(-time.Second).UnixNano()
+	ex.confirmSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementPending)
+	assert.Equal(t, record.Attempts, 1)
+	assert.True(t, record.NextAttemptAt > time.Now().UnixNano())
+
+	// Out of attempts, it is left to be looked at by hand
+	for record.Status == SettlementPending {
+		ex.submitSettlement(record)
+		record, _ = ex.settlements.get(1)
+		record.ConfirmBy = 0
+		ex.confirmSettlement(record)
+		record, _ = ex.settlements.get(1)
+	}
+	assert.Equal(t, record.Status, SettlementFailed)
+	assert.Equal(t, record.Attempts, maxSettlementAttempts)
+	assert.Equal(t, settlement.signed, 1)
+}
+
+func TestSettlementReverted(t *testing.T) {
+	settlement := newFakeSettlement()
+	ex := newTestExchange(t, settlement)
+
+	ex.submitSettlement(enqueueTestSettlement(ex))
+	record, _ := ex.settlements.get(1)
+
+	settlement.reverted = true
+	ex.confirmSettlement(record)
+	record, _ = ex.settlements.get(1)
+	assert.Equal(t, record.Status, SettlementFailed)
+	assert.Equal(t, record.Error, ErrTransferReverted.Error())
+}
+
+func TestSettlementBackoff(t *testing.T) {
+	assert.Equal(t, settlementBackoff(1), settlementFirstRetry)
+	assert.Equal(t, settlementBackoff(2), 2 * settlementFirstRetry)
+	assert.Equal(t, settlementBackoff(4), 8 * settlementFirstRetry)
+	assert.Equal(t, settlementBackoff(maxSettlementAttempts * 10), settlementMaxRetry)
+}
+
+func TestSettlementJournalReplay(t *testing.T) {
+	settlement := newFakeSettlement()
+	settlement.sendErr = errors.New("connection reset")
+	ex := newTestExchange(t, settlement)
+
+	ex.submitSettlement(enqueueTestSettlement(ex))
+	record, _ := ex.settlements.get(1)
+
+	// The signed transfer survives a restart
+	queue, err := newSettlementQueue(ex.settlements.path)
+	assert.Nil(t, err)
+	replayed, ok := queue.get(1)
+	assert.True(t, ok)
+	assert.Equal(t, replayed.Status, SettlementPending)
+	assert.Equal(t, replayed.TxHash, record.TxHash)
+	assert.Equal(t, replayed.TxNonce, record.TxNonce)
+	assert.Equal(t, replayed.RawTx, record.RawTx)
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	StatusNew 						OrderStatus = "NEW"
+	StatusPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+	StatusFilled 					OrderStatus = "FILLED"
+	StatusCancelled 			OrderStatus = "CANCELLED"
+	StatusRejected 				OrderStatus = "REJECTED"
+	StatusExpired 				OrderStatus = "EXPIRED"
+
+	// How long the records of filled, cancelled, rejected
+	// and expired orders can still be looked up
+	terminalOrderRetention = 24 * time.Hour
+)
+
+type (
+	OrderStatus string
+
+	// Lifecycle of an order, from its placement to its last state
+	OrderRecord struct {
+		ID 						int64
+		ClientOrderID string `json:",omitempty"`
+		UserID 				int64
+		Market 				Market
+		Type 					OrderType
+		Bid 					bool
+		// Limit price, 0 for market orders
+		Price 				decimal.Decimal
+		StopPrice 		decimal.Decimal
+		Size 					decimal.Decimal
+		FilledSize 		decimal.Decimal
+		AvgFillPrice 	decimal.Decimal
+		RemainingSize decimal.Decimal
+		Status 				OrderStatus
+		// Matches with orders of the same user which were prevented
+		PreventedMatches []PreventedMatch
+		// Why the order got rejected
+		Reason 				string
+		CreatedAt 		int64
+		UpdatedAt 		int64
+
+		// Response of the placement, returned again to a duplicate submission
+		result *PlaceOrderResponse
+	}
+
+	PreventedMatch struct {
+		MakerOrderID 		int64
+		TakerOrderID 		int64
+		Mode 						orderbook.SelfTradePrevention
+		Price 					decimal.Decimal
+		Size 						decimal.Decimal
+		MakerCancelled 	bool
+		TakerCancelled 	bool
+	}
+
+	orderRecords struct {
+		mu 				sync.RWMutex
+		records 	map[int64]*OrderRecord
+		// Filled notional of each order, to compute the average fill price
+		notional 	map[int64]decimal.Decimal
+		// Terminal orders in the order they got there, the oldest are pruned first
+		terminal 	[]terminalOrder
+		// Orders by the ID their user gave them
+		clientIDs map[clientOrderID]int64
+		// Called with the ID of every order reaching a terminal state
+		onTerminal func(id int64)
+	}
+
+	clientOrderID struct {
+		userID 	int64
+		id 			string
+	}
+
+	terminalOrder struct {
+		id int64
+		at int64
+	}
+)
+
+func (s OrderStatus) IsTerminal() bool {
+	return s == StatusFilled || s == StatusCancelled || s == StatusRejected || s == StatusExpired
+}
+
+func newOrderRecords() *orderRecords {
+	return &orderRecords{
+		records: 	make(map[int64]*OrderRecord),
+		notional: make(map[int64]decimal.Decimal),
+		clientIDs: make(map[clientOrderID]int64),
+	}
+}
+
+// add starts tracking an order which was just accepted. When the user
+// already submitted an order with the same client order ID, nothing is
+// added and the record of that order is returned instead.
+func (r *orderRecords) add(market Market, p PlaceOrderRequest, order *orderbook.Order) (OrderRecord, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p.ClientOrderID != "" {
+		key := clientOrderID{userID: p.UserID, id: p.ClientOrderID}
+		if id, ok := r.clientIDs[key]; ok {
+			return *r.records[id], false
+		}
+		r.clientIDs[key] = order.ID
+	}
+
+	now := time.Now().UnixNano()
+	r.records[order.ID] = &OrderRecord{
+		ID: 						order.ID,
+		ClientOrderID: 	p.ClientOrderID,
+		UserID: 				order.UserID,
+		Market: 				market,
+		Type: 					p.Type,
+		Bid: 						order.Bid,
+		Price: 					p.Price,
+		StopPrice: 			p.StopPrice,
+		Size: 					p.Size,
+		RemainingSize: 	p.Size,
+		Status: 				StatusNew,
+		CreatedAt: 			now,
+		UpdatedAt: 			now,
+	}
+
+	return OrderRecord{}, true
+}
+
+// byClientID returns the record of the order a user submitted with a client order ID
+func (r *orderRecords) byClientID(userID int64, id string) (OrderRecord, bool) {
+	r.mu.RLock()
+	orderID, ok := r.clientIDs[clientOrderID{userID: userID, id: id}]
+	r.mu.RUnlock()
+
+	if !ok {
+		return OrderRecord{}, false
+	}
+
+	return r.get(orderID)
+}
+
+// setResult keeps the response of the placement of an order
+func (r *orderRecords) setResult(id int64, result *PlaceOrderResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if record, ok := r.records[id]; ok {
+		record.result = result
+	}
+}
+
+func (r *orderRecords) get(id int64) (OrderRecord, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	record, ok := r.records[id]
+	if !ok {
+		return OrderRecord{}, false
+	}
+
+	return *record, true
+}
+
+// fill applies the matches to the orders on both of their sides. Orders
+// which got out of the book without being fully filled are cancelled,
+// e.g. the remainder of an IOC order or of a triggered stop-market order.
+func (r *orderRecords) fill(matches []orderbook.Match) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for _, match := range matches {
+		for _, order := range []*orderbook.Order{match.Ask, match.Bid} {
+			record, ok := r.records[order.ID]
+			if !ok || record.Status.IsTerminal() {
+				continue
+			}
+
+			r.notional[order.ID] += match.SizeFilled.Mul(match.Price)
+			record.FilledSize += match.SizeFilled
+			record.AvgFillPrice = r.notional[order.ID].MulDiv(int64(decimal.One), int64(record.FilledSize))
+			record.UpdatedAt = now
+		}
+	}
+
+	for _, match := range matches {
+		for _, order := range []*orderbook.Order{match.Ask, match.Bid} {
+			r.settle(order, now)
+		}
+	}
+}
+
+// settle moves the record of order to the state the order is in after
+// its placement or a fill
+func (r *orderRecords) settle(order *orderbook.Order, now int64) {
+	record, ok := r.records[order.ID]
+	if !ok || record.Status.IsTerminal() {
+		return
+	}
+
+	record.RemainingSize = order.TotalSize()
+	record.UpdatedAt = now
+
+	switch {
+	case order.IsFilled():
+		r.terminate(record, StatusFilled, now)
+	case order.Limit == nil:
+		r.terminate(record, StatusCancelled, now)
+	case record.FilledSize > 0:
+		record.Status = StatusPartiallyFilled
+	}
+}
+
+// prevent reports the prevented self trades on the orders on both of their
+// sides, the resting orders are settled as they may have been cancelled
+func (r *orderRecords) prevent(prevented []orderbook.PreventedMatch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for _, pm := range prevented {
+		report := PreventedMatch{
+			MakerOrderID: 	pm.Maker.ID,
+			TakerOrderID: 	pm.Taker.ID,
+			Mode: 					pm.Mode,
+			Price: 					pm.Price,
+			Size: 					pm.Size,
+			MakerCancelled: pm.MakerCancelled,
+			TakerCancelled: pm.TakerCancelled,
+		}
+
+		for _, id := range []int64{pm.Maker.ID, pm.Taker.ID} {
+			if record, ok := r.records[id]; ok {
+				record.PreventedMatches = append(record.PreventedMatches, report)
+				record.UpdatedAt = now
+			}
+		}
+
+		r.settle(pm.Maker, now)
+	}
+}
+
+// placed settles the order once it went through the orderbook,
+// pending stop orders are not settled until they trigger
+func (r *orderRecords) placed(order *orderbook.Order) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.settle(order, time.Now().UnixNano())
+}
+
+// amend records the new price and remaining size of an amended order
+func (r *orderRecords) amend(id int64, price, size decimal.Decimal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[id]
+	if !ok || record.Status.IsTerminal() {
+		return
+	}
+
+	record.Price = price
+	record.Size = record.FilledSize + size
+	record.RemainingSize = size
+	record.UpdatedAt = time.Now().UnixNano()
+}
+
+// finish moves an order which left the book to a terminal state
+func (r *orderRecords) finish(id int64, status OrderStatus, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[id]
+	if !ok || record.Status.IsTerminal() {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	record.Reason = reason
+	record.UpdatedAt = now
+	if status == StatusRejected {
+		record.RemainingSize = decimal.Zero
+	}
+
+	r.terminate(record, status, now)
+}
+
+func (r *orderRecords) terminate(record *OrderRecord, status OrderStatus, now int64) {
+	record.Status = status
+	delete(r.notional, record.ID)
+	r.terminal = append(r.terminal, terminalOrder{id: record.ID, at: now})
+
+	if r.onTerminal != nil {
+		r.onTerminal(record.ID)
+	}
+}
+
+// prune forgets the terminal orders older than the retention
+func (r *orderRecords) prune(now int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := now - int64(terminalOrderRetention)
+
+	i := 0
+	for ; i < len(r.terminal) && r.terminal[i].at < cutoff; i++ {
+		record := r.records[r.terminal[i].id]
+		if record.ClientOrderID != "" {
+			delete(r.clientIDs, clientOrderID{userID: record.UserID, id: record.ClientOrderID})
+		}
+		delete(r.records, record.ID)
+	}
+	r.terminal = r.terminal[i:]
+}
+
+func (ex *Exchange) handleGetOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid id"})
+	}
+
+	record, ok := ex.records.get(id)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "order not found"})
+	}
+
+	return c.JSON(http.StatusOK, record)
+}
+
+func (ex *Exchange) handleGetOrderByClientID(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user ID"})
+	}
+
+	record, ok := ex.records.byClientID(userID, c.Param("clientOrderID"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "order not found"})
+	}
+
+	return c.JSON(http.StatusOK, record)
+}
+
+func (ex *Exchange) handleCancelOrderByClientID(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user ID"})
+	}
+
+	record, ok := ex.records.byClientID(userID, c.Param("clientOrderID"))
+	if !ok || !ex.cancelOrder(record.ID) {
+		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "order not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "order cancelled", "id": record.ID})
+}
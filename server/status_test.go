@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Simon-Busch/go_crypto_exchange/decimal"
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderStatusLifecycle(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	ask := placeTestOrder(t, ex, limitOrder(1, false, "3", "1000"))
+	record, ok := ex.records.get(ask.OrderID)
+	assert.True(t, ok)
+	assert.Equal(t, record.Status, StatusNew)
+	assert.Equal(t, record.RemainingSize, 3 * decimal.One)
+
+	bid := placeTestOrder(t, ex, limitOrder(8, true, "1", "1000"))
+	record, _ = ex.records.get(ask.OrderID)
+	assert.Equal(t, record.Status, StatusPartiallyFilled)
+	assert.Equal(t, record.FilledSize, decimal.One)
+	assert.Equal(t, record.RemainingSize, 2 * decimal.One)
+
+	record, _ = ex.records.get(bid.OrderID)
+	assert.Equal(t, record.Status, StatusFilled)
+	assert.Equal(t, record.AvgFillPrice, 1000 * decimal.One)
+	assert.Equal(t, record.RemainingSize, decimal.Zero)
+
+	assert.True(t, ex.cancelOrder(ask.OrderID))
+	record, _ = ex.records.get(ask.OrderID)
+	assert.Equal(t, record.Status, StatusCancelled)
+
+	// Terminal states are final
+	ex.records.finish(ask.OrderID, StatusExpired, "")
+	record, _ = ex.records.get(ask.OrderID)
+	assert.Equal(t, record.Status, StatusCancelled)
+	assert.False(t, ex.cancelOrder(ask.OrderID))
+}
+
+func TestOrderStatusRejectedAndCancelled(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+
+	postOnly := limitOrder(8, true, "1", "1000")
+	postOnly.PostOnly = true
+	postOnly.ClientOrderID = "post-only"
+	_, err := ex.placeOrder(postOnly)
+	var rejected *RejectedOrderError
+	assert.ErrorAs(t, err, &rejected)
+
+	record, ok := ex.records.byClientID(8, "post-only")
+	assert.True(t, ok)
+	assert.Equal(t, record.Status, StatusRejected)
+	assert.Equal(t, record.Reason, orderbook.ErrPostOnlyWouldCross.Error())
+	assert.Equal(t, record.RemainingSize, decimal.Zero)
+
+	// The remainder of an IOC order is cancelled
+	ioc := limitOrder(8, true, "3", "1000")
+	ioc.TimeInForce = orderbook.ImmediateOrCancel
+	resp := placeTestOrder(t, ex, ioc)
+	record, _ = ex.records.get(resp.OrderID)
+	assert.Equal(t, record.Status, StatusCancelled)
+	assert.Equal(t, record.FilledSize, decimal.One)
+}
+
+func TestStopOrderStatus(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	stop := PlaceOrderRequest{
+		Type: 			StopMarketOrder,
+		Bid: 				true,
+		Size: 			decimal.One,
+		StopPrice: 	1000 * decimal.One,
+		Market: 		MarketETH,
+		UserID: 		8,
+	}
+	resp := placeTestOrder(t, ex, stop)
+	record, _ := ex.records.get(resp.OrderID)
+	assert.Equal(t, record.Status, StatusNew)
+
+	// The trade triggers the stop into a book without asks, so it is cancelled
+	placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+	placeTestOrder(t, ex, limitOrder(8, true, "1", "1000"))
+
+	record, _ = ex.records.get(resp.OrderID)
+	assert.Equal(t, record.Status, StatusCancelled)
+	assert.Equal(t, record.FilledSize, decimal.Zero)
+	assert.Equal(t, len(ex.Orders[8]), 0)
+	for _, b := range ex.ledger.balancesOf(8) {
+		assert.Equal(t, b.Locked, decimal.Zero)
+	}
+}
+
+func TestHandleGetOrder(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+	resp := placeTestOrder(t, ex, limitOrder(1, false, "1", "1000"))
+
+	get := func(id string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/order/status/"+id, nil), rec)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+		assert.Nil(t, ex.handleGetOrder(c))
+		return rec
+	}
+
+	rec := get(strconv.FormatInt(resp.OrderID, 10))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	var record OrderRecord
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &record))
+	assert.Equal(t, record.ID, resp.OrderID)
+	assert.Equal(t, record.Status, StatusNew)
+
+	assert.Equal(t, get("12345").Code, http.StatusBadRequest)
+	assert.Equal(t, get("abc").Code, http.StatusBadRequest)
+}
+
+func TestClientOrderIDResubmission(t *testing.T) {
+	ex := newTestExchange(t, internalSettlement{})
+
+	p := limitOrder(8, true, "1", "990")
+	p.ClientOrderID = "a"
+	first := placeTestOrder(t, ex, p)
+	second := placeTestOrder(t, ex, p)
+	assert.Equal(t, second, first)
+	assert.Equal(t, len(ex.Orders[8]), 1)
+	for _, b := range ex.ledger.balancesOf(8) {
+		if b.Asset == "USD" {
+			assert.Equal(t, b.Locked, 990 * decimal.One)
+		}
+	}
+
+	// Client order IDs are per user
+	p.UserID = 1
+	other := placeTestOrder(t, ex, p)
+	assert.NotEqual(t, other.OrderID, first.OrderID)
+
+	// A rejected order is rejected again without being placed
+	unfunded := limitOrder(8, true, "1000", "20000")
+	unfunded.ClientOrderID = "b"
+	_, err := ex.placeOrder(unfunded)
+	assert.NotNil(t, err)
+	_, again := ex.placeOrder(unfunded)
+	assert.Equal(t, again.Error(), err.Error())
+	record, _ := ex.records.byClientID(8, "b")
+	assert.Equal(t, record.Status, StatusRejected)
+
+	// Cancelled by its client order ID, a resubmission doesn't place it again
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/users/8/orders/a", nil), rec)
+	c.SetParamNames("userID", "clientOrderID")
+	c.SetParamValues("8", "a")
+	assert.Nil(t, ex.handleCancelOrderByClientID(c))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	record, _ = ex.records.byClientID(8, "a")
+	assert.Equal(t, record.Status, StatusCancelled)
+	p.UserID = 8
+	assert.Equal(t, placeTestOrder(t, ex, p), first)
+	assert.Equal(t, len(ex.Orders[8]), 0)
+}
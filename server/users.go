@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Simon-Busch/go_crypto_exchange/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults applied to every order of a user
+type UserSettings struct {
+	// Used by the orders which don't set their own
+	SelfTradePrevention orderbook.SelfTradePrevention
+}
+
+func (ex *Exchange) userSettings(userID int64) UserSettings {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	return ex.settings[userID]
+}
+
+func (ex *Exchange) handleGetUserSettings(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user ID"})
+	}
+
+	return c.JSON(http.StatusOK, ex.userSettings(userID))
+}
+
+func (ex *Exchange) handlePutUserSettings(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user ID"})
+	}
+
+	var settings UserSettings
+	if err := json.NewDecoder(c.Request().Body).Decode(&settings); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request"})
+	}
+
+	if !settings.SelfTradePrevention.IsValid() {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid self-trade prevention: " + string(settings.SelfTradePrevention)})
+	}
+
+	ex.mu.Lock()
+	ex.settings[userID] = settings
+	ex.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"userID": 							userID,
+		"selfTradePrevention": 	settings.SelfTradePrevention,
+	}).Info("Updated user settings")
+
+	return c.JSON(http.StatusOK, settings)
+}